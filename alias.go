@@ -0,0 +1,220 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/grailbio/base/log"
+)
+
+// maxAliasDepth limits the length of alias chains, so that alias
+// cycles are detected.
+const maxAliasDepth = 16
+
+type alias struct {
+	name       string
+	deprecated bool
+	message    string
+}
+
+// RegisterAlias registers old as an alias for the provider name in
+// DefaultRegistry. See Registry.RegisterAlias.
+func RegisterAlias(old, name string) {
+	DefaultRegistry.RegisterAlias(old, name)
+}
+
+// RegisterDeprecated registers the deprecated provider name as an
+// alias for the provider replacement in DefaultRegistry. See
+// Registry.RegisterDeprecated.
+func RegisterDeprecated(name, replacement, message string) {
+	DefaultRegistry.RegisterDeprecated(name, replacement, message)
+}
+
+// RegisterAlias registers old as an alias for the provider name in
+// the registry r. Aliases are used to rename providers without
+// breaking configurations that refer to them by their old names:
+// when a configuration is made, references to old are resolved to
+// name, and the provider's configuration, instance configuration,
+// outputs, and version are moved from old to name, so that the
+// configuration is marshaled with the new name. Aliases may refer
+// to other aliases. RegisterAlias panics if either name is invalid,
+// or if old is already registered as a provider or an alias.
+func (r *Registry) RegisterAlias(old, name string) {
+	r.registerAlias(old, alias{name: name})
+}
+
+// RegisterDeprecated registers the deprecated provider name as an
+// alias for the provider replacement in the registry r, as in
+// RegisterAlias. Additionally, a warning including the provided
+// message is logged whenever a configuration refers to the
+// deprecated name.
+func (r *Registry) RegisterDeprecated(name, replacement, message string) {
+	r.registerAlias(name, alias{name: replacement, deprecated: true, message: message})
+}
+
+func (r *Registry) registerAlias(old string, a alias) {
+	for _, name := range []string{old, a.name} {
+		for _, c := range name {
+			if '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-' || c == '_' {
+				continue
+			}
+			log.Panicf("infra.RegisterAlias: invalid name %s: identifiers may only contain 0-9, a-z, -, or _", name)
+		}
+	}
+	if reservedName(old) {
+		panic("infra.RegisterAlias: key " + old + " is reserved")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.providers[old] != nil {
+		panic("infra.RegisterAlias: provider named " + old + " is already registered")
+	}
+	if r.decorators[old] != nil {
+		panic("infra.RegisterAlias: " + old + " is already registered as a decorator")
+	}
+	if _, ok := r.aliases[old]; ok {
+		panic("infra.RegisterAlias: alias " + old + " is already registered")
+	}
+	r.aliases[old] = a
+}
+
+// resolve returns the name of the provider to which the provided
+// name resolves, along with the deprecated aliases that were
+// traversed in the process.
+func (r *Registry) resolve(name string) (string, []alias, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deprecated []alias
+	for i := 0; ; i++ {
+		a, ok := r.aliases[name]
+		if !ok {
+			return name, deprecated, nil
+		}
+		if i == maxAliasDepth {
+			return "", nil, fmt.Errorf("alias %s: too many levels of aliasing", name)
+		}
+		if a.deprecated {
+			deprecated = append(deprecated, alias{name: name, message: a.message})
+		}
+		name = a.name
+	}
+}
+
+// resolveAliases rewrites the configuration's keys so that they
+// refer to providers by their current names, moving aliased
+// providers' configurations, instance configurations, outputs, and
+// versions to their current names. The candidates of firstof keys
+// are resolved individually.
+func (c *Config) resolveAliases() error {
+	for _, key := range c.types {
+		value, ok := c.Keys[key].(string)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(value, firstOfName+"(") {
+			old := providerName(value)
+			name, err := c.resolveAlias(key, old)
+			if err != nil {
+				return err
+			}
+			c.Keys[key] = name + strings.TrimPrefix(value, old)
+			continue
+		}
+		end := strings.Index(value, ")")
+		if end < 0 {
+			continue
+		}
+		names := firstOfNames(value[len(firstOfName)+1 : end])
+		for i, old := range names {
+			name, err := c.resolveAlias(key, old)
+			if err != nil {
+				return err
+			}
+			names[i] = name
+			if name != old {
+				renameChoice(c.Keys["instances"], key, old, name)
+			}
+		}
+		c.Keys[key] = firstOfName + "(" + strings.Join(names, ",") + value[end:]
+	}
+	return nil
+}
+
+// resolveAlias returns the current name of the provider named old,
+// as configured for the provided key, logging a warning for each
+// deprecated alias traversed. If old is an alias, the keys of the
+// aliased provider are moved to the current name.
+func (c *Config) resolveAlias(key, old string) (string, error) {
+	name, deprecated, err := c.registry.resolve(old)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", key, err)
+	}
+	for _, a := range deprecated {
+		log.Printf("infra: %s: provider %s is deprecated; use %s instead: %s", key, a.name, name, a.message)
+	}
+	if name == old {
+		return name, nil
+	}
+	renameKey(c.Keys, old, name)
+	for _, k := range []string{"versions", "instances", "outputs"} {
+		renameKey(c.Keys[k], old, name)
+	}
+	return name, nil
+}
+
+// renameChoice renames the recorded choice of the firstof instance
+// of the provided key from old to name, if present in the instance
+// configurations instances.
+func renameChoice(instances interface{}, key, old, name string) {
+	v := reflect.ValueOf(instances)
+	if v.Kind() != reflect.Map {
+		return
+	}
+	config := v.MapIndex(reflect.ValueOf(firstOfName + "@" + key))
+	if !config.IsValid() {
+		return
+	}
+	config = reflect.ValueOf(config.Interface())
+	if config.Kind() != reflect.Map {
+		return
+	}
+	choice := reflect.ValueOf("choice")
+	if v := config.MapIndex(choice); v.IsValid() && v.Interface() == old {
+		config.SetMapIndex(choice, reflect.ValueOf(name))
+	}
+}
+
+// renameKey renames the key old to name in the map m, unless name
+// is already present.
+func renameKey(m interface{}, old, name string) {
+	switch m := m.(type) {
+	case Keys:
+		renameKey(map[string]interface{}(m), old, name)
+	case map[string]interface{}:
+		if v, ok := m[old]; ok {
+			if _, ok := m[name]; !ok {
+				m[name] = v
+			}
+			delete(m, old)
+		}
+	case map[interface{}]interface{}:
+		if v, ok := m[old]; ok {
+			if _, ok := m[name]; !ok {
+				m[name] = v
+			}
+			delete(m, old)
+		}
+	case map[string]int:
+		if v, ok := m[old]; ok {
+			if _, ok := m[name]; !ok {
+				m[name] = v
+			}
+			delete(m, old)
+		}
+	}
+}
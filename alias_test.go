@@ -0,0 +1,119 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func init() {
+	infra.RegisterAlias("testcredsv0", "testcreds")
+	infra.RegisterDeprecated("testclusterv0", "testcluster", "testclusterv0 was renamed")
+}
+
+func TestAlias(t *testing.T) {
+	config, err := schema.Unmarshal([]byte(`creds: testcredsv0,user=xyz
+cluster: testclusterv0
+testclusterv0:
+  instance_type: abc
+versions:
+  testclusterv0: 1
+instances:
+  testclusterv0:
+    instance_user: fromcluster
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cluster *testCluster
+	config.Must(&cluster)
+	if got, want := cluster.InstanceType, "abc"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.User, "fromcluster"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"creds: testcreds,user=xyz\n",
+		"cluster: testcluster\n",
+		"testcluster:\n  instance_type: abc\n",
+		"  testcluster: 1\n",
+		"  testcluster:\n    instance_user: fromcluster\n",
+	} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+	if strings.Contains(string(p), "v0") {
+		t.Errorf("marshaled config %s refers to aliases", p)
+	}
+}
+
+func TestAliasCycle(t *testing.T) {
+	reg := infra.NewRegistry()
+	reg.RegisterAlias("a", "b")
+	reg.RegisterAlias("b", "a")
+	_, err := infra.Schema{"creds": new(testCreds)}.MakeWithRegistry(reg, infra.Keys{"creds": "a"})
+	if err == nil || !strings.Contains(err.Error(), "too many levels of aliasing") {
+		t.Errorf("got %v, want aliasing error", err)
+	}
+}
+
+func TestAliasInvalidName(t *testing.T) {
+	for _, names := range [][2]string{
+		{"CAPS", "testcreds"},
+		{"old*name", "testcreds"},
+		{"testcredsv1", "Test Creds"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s -> %s: expected panic", names[0], names[1])
+				}
+			}()
+			infra.NewRegistry().RegisterAlias(names[0], names[1])
+		}()
+	}
+}
+
+func TestAliasFirstOf(t *testing.T) {
+	reg := infra.NewRegistry()
+	reg.Register("teststore", new(testStore))
+	reg.Register("testremotestore", new(testRemoteStore))
+	reg.RegisterAlias("teststorev0", "teststore")
+	schema := infra.Schema{"store": new(Store)}
+	config, err := schema.UnmarshalWithRegistry(reg, []byte(`store: firstof(testremotestore,teststorev0)
+instances:
+  firstof@store:
+    choice: teststorev0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store Store
+	config.Must(&store)
+	if got, want := store.Get("k"), "value:k"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"store: firstof(testremotestore,teststore)\n",
+		"firstof@store:\n    choice: teststore\n",
+	} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// An AuditEntry records a single provider setup performed by a
+// configuration.
+type AuditEntry struct {
+	// Time is the time at which setup completed.
+	Time time.Time `yaml:"time"`
+	// Key is the schema key of the instance that was set up.
+	Key string `yaml:"key"`
+	// Provider is the name of the instance's provider.
+	Provider string `yaml:"provider"`
+	// FromVersion is the instance's configured version before
+	// setup, or -1 if it was never set up.
+	FromVersion int `yaml:"from_version"`
+	// ToVersion is the provider version that setup brings the
+	// instance to.
+	ToVersion int `yaml:"to_version"`
+	// User and Host identify the user and host that performed the
+	// setup.
+	User string `yaml:"user,omitempty"`
+	Host string `yaml:"host,omitempty"`
+	// Diff is a line diff of the (redacted) provider configuration
+	// before and after setup.
+	Diff string `yaml:"diff,omitempty"`
+	// Error is the error returned by setup, if it failed.
+	Error string `yaml:"error,omitempty"`
+}
+
+// An AuditSink receives audit log entries as they are recorded.
+type AuditSink interface {
+	// Audit records the provided entry.
+	Audit(entry AuditEntry) error
+}
+
+// AuditOptions determine how a configuration's audit log is
+// persisted.
+type AuditOptions struct {
+	// Persist indicates that the audit log should be marshaled with
+	// the configuration, under the reserved key "infra". Audit logs
+	// that are restored from a marshaled configuration are always
+	// marshaled again.
+	Persist bool
+	// Sink, if not nil, receives each entry as it is recorded.
+	// Setup fails if the sink returns an error.
+	Sink AuditSink
+}
+
+// auditLog is a configuration's append-only audit log.
+type auditLog struct {
+	mu      sync.Mutex
+	opts    AuditOptions
+	loaded  bool
+	entries []AuditEntry
+}
+
+// SetAudit sets the options for the configuration's audit log. An
+// entry is appended to the audit log for every provider setup
+// performed by the configuration, whether it succeeds or fails.
+// Audit entries include a diff of the provider's configuration,
+// from which sensitive values are redacted (see MarshalRedacted).
+func (c Config) SetAudit(opts AuditOptions) {
+	defer c.lock()()
+	c.audit.mu.Lock()
+	c.audit.opts = opts
+	c.audit.mu.Unlock()
+}
+
+// AuditLog returns the entries of the configuration's audit log,
+// including those restored from a marshaled configuration, in the
+// order in which they were recorded.
+func (c Config) AuditLog() []AuditEntry {
+	defer c.rlock()()
+	c.audit.mu.Lock()
+	defer c.audit.mu.Unlock()
+	return append([]AuditEntry(nil), c.audit.entries...)
+}
+
+// load restores the audit log stored in the provided keys.
+func (a *auditLog) load(keys Keys) error {
+	meta, _, err := keys.Keys(infraKey)
+	if err != nil {
+		return err
+	}
+	entries, ok := meta["audit"]
+	if !ok {
+		return nil
+	}
+	if err := remarshal(entries, &a.entries); err != nil {
+		return fmt.Errorf("audit log: %v", err)
+	}
+	a.loaded = len(a.entries) > 0
+	return nil
+}
+
+// marshal stores the audit log in the provided keys, if it is to be
+// persisted.
+func (a *auditLog) marshal(keys Keys) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.opts.Persist && !a.loaded || len(a.entries) == 0 {
+		return
+	}
+	meta, _ := keys[infraKey].(map[interface{}]interface{})
+	if meta == nil {
+		meta = make(map[interface{}]interface{})
+		keys[infraKey] = meta
+	}
+	meta["audit"] = a.entries
+}
+
+// record appends the provided entry to the audit log.
+func (a *auditLog) record(entry AuditEntry) error {
+	a.mu.Lock()
+	a.entries = append(a.entries, entry)
+	sink := a.opts.Sink
+	a.mu.Unlock()
+	if sink == nil {
+		return nil
+	}
+	if err := sink.Audit(entry); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	return nil
+}
+
+// setMeta records the configuration's metadata, its format version
+// and audit log, in the provided keys.
+func (c Config) setMeta(keys Keys) {
+	c.schema.setFormatVersion(keys)
+	c.audit.marshal(keys)
+}
+
+// setupInstance performs setup of the provided instance, recording
+// it in the audit log if the instance's provider implements Setup.
+func (c Config) setupInstance(inst *instance) error {
+	if !inst.HasSetup() {
+		return nil
+	}
+	entry := AuditEntry{
+		Key:         c.key(inst),
+		Provider:    inst.Impl(),
+		FromVersion: -1,
+		ToVersion:   inst.Version(),
+	}
+	if version, ok := c.versions[inst.Impl()]; ok {
+		entry.FromVersion = version
+	}
+	before := auditSnapshot(inst)
+	err := inst.Setup()
+	entry.Time = time.Now()
+	entry.Diff = diffLines(before, auditSnapshot(inst))
+	if u, uerr := user.Current(); uerr == nil {
+		entry.User = u.Username
+	}
+	entry.Host, _ = os.Hostname()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if aerr := c.audit.record(entry); aerr != nil && err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// auditSnapshot returns the redacted, YAML-formatted provider
+// configuration of the provided instance.
+func auditSnapshot(inst *instance) string {
+	config := inst.Config()
+	if config == nil {
+		return ""
+	}
+	v, err := redact(config, reflect.TypeOf(config), inst.Sensitive())
+	if err != nil {
+		return ""
+	}
+	p, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(p)
+}
+
+// diffLines returns a line diff of the strings a and b, in which
+// removed lines are prefixed by "-" and added lines by "+". Common
+// lines are omitted.
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x, y := strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of
+	// x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var (
+		b2   strings.Builder
+		i, j int
+	)
+	line := func(prefix, s string) {
+		if s == "" {
+			return
+		}
+		b2.WriteString(prefix)
+		b2.WriteString(strings.TrimSuffix(s, "\n"))
+		b2.WriteString("\n")
+	}
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", x[i])
+			i++
+		default:
+			line("+", y[j])
+			j++
+		}
+	}
+	return b2.String()
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type auditSinkFunc func(infra.AuditEntry) error
+
+func (f auditSinkFunc) Audit(entry infra.AuditEntry) error { return f(entry) }
+
+func TestAudit(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sunk []infra.AuditEntry
+	config.SetAudit(infra.AuditOptions{
+		Persist: true,
+		Sink: auditSinkFunc(func(entry infra.AuditEntry) error {
+			sunk = append(sunk, entry)
+			return nil
+		}),
+	})
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	entries := config.AuditLog()
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := len(sunk), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	entry := entries[0]
+	if got, want := entry.Key, "cluster"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := entry.FromVersion, -1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := entry.ToVersion, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, want := range []string{"-setup_user: \"\"\n", "+setup_user: xyz\n", "+num_instances: 123\n"} {
+		if !strings.Contains(entry.Diff, want) {
+			t.Errorf("diff %q does not contain %q", entry.Diff, want)
+		}
+	}
+
+	// The audit log is restored with the configuration.
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(config.AuditLog()), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := config.AuditLog()[0].Diff, entry.Diff; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAuditSinkError(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetAudit(infra.AuditOptions{
+		Sink: auditSinkFunc(func(infra.AuditEntry) error {
+			return errors.New("sink unavailable")
+		}),
+	})
+	if err := config.Setup(); err == nil || !strings.Contains(err.Error(), "sink unavailable") {
+		t.Errorf("got %v, want sink error", err)
+	}
+	// Without Persist, the log is not marshaled.
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "audit") {
+		t.Errorf("unexpected audit log in %s", p)
+	}
+}
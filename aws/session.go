@@ -17,16 +17,24 @@ import (
 )
 
 func init() {
-	infra.Register("awssession", new(Session))
-	infra.Register("awstool", new(AWSTool))
-	infra.Register("awscreds", new(AWSCreds))
-	infra.Register("awsregion", AWSRegion(""))
-	infra.Register("awsregionuswest2", new(AWSRegionUSWest2))
+	RegisterProviders(infra.DefaultRegistry)
+}
+
+// RegisterProviders registers the providers defined by this package
+// in the registry reg. They are registered in infra.DefaultRegistry
+// when the package is initialized.
+func RegisterProviders(reg *infra.Registry) {
+	reg.Register("awssession", new(Session))
+	reg.Register("awstool", new(AWSTool))
+	reg.Register("awscreds", new(AWSCreds))
+	reg.Register("awsregion", AWSRegion(""))
+	reg.Register("awsregionuswest2", new(AWSRegionUSWest2))
+	reg.Register("s3state", new(S3Store))
 }
 
 type instance struct {
 	Region string            `yaml:"region"`
-	Creds  credentials.Value `yaml:"credentials"`
+	Creds  credentials.Value `yaml:"credentials" infra:"secret"`
 }
 
 // Session is an infrastructure provider for AWS SDK sessions. It
@@ -36,7 +44,8 @@ type instance struct {
 //
 // Session supports instance marshaling, performed by inlining
 // credentials and the session's region. Other configuration
-// parameters are currently not propagated by this method.
+// parameters are currently not propagated by this method. The
+// inlined credentials are marshaled as secrets; see infra.Secret.
 //
 // TODO(marius): copy ~/.aws/config outright when we can? This could
 // get complicated in the presence of profiles.
@@ -0,0 +1,201 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/grailbio/infra"
+)
+
+// S3Store is an infra.StateStore that stores a configuration in an
+// S3 object. Revisions are the object's ETags. The store's lock is
+// implemented by a conditional write to a DynamoDB table, whose
+// (string) hash key must be named "LockID". Since S3 does not
+// support conditional writes, compare-and-swap is guaranteed only
+// among parties that hold the lock while saving.
+//
+// S3Store is also an infrastructure provider, configured by the
+// flags bucket, key, and locktable, so that a configuration's state
+// store may itself be configured.
+type S3Store struct {
+	Bucket    string
+	Key       string
+	LockTable string
+
+	s3 s3iface.S3API
+	db dynamodbiface.DynamoDBAPI
+
+	mu    sync.Mutex
+	owner string
+}
+
+// NewS3Store returns a new S3Store that stores its configuration in
+// the provided S3 bucket and key, using the provided DynamoDB table
+// for locking.
+func NewS3Store(sess *session.Session, bucket, key, lockTable string) *S3Store {
+	return &S3Store{
+		Bucket:    bucket,
+		Key:       key,
+		LockTable: lockTable,
+		s3:        s3.New(sess),
+		db:        dynamodb.New(sess),
+	}
+}
+
+// Help implements infra.Provider.
+func (*S3Store) Help() string {
+	return "store configuration state in S3, locked by a DynamoDB table"
+}
+
+// Flags implements infra.Provider.
+func (s *S3Store) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&s.Bucket, "bucket", "", "S3 bucket in which the state is stored")
+	flags.StringVar(&s.Key, "key", "", "S3 key at which the state is stored")
+	flags.StringVar(&s.LockTable, "locktable", "", "DynamoDB table used to lock the state")
+}
+
+// Init implements infra.Provider.
+func (s *S3Store) Init(sess *session.Session) error {
+	if s.Bucket == "" || s.Key == "" {
+		return errors.New("aws.S3Store: bucket and key must be specified")
+	}
+	s.s3 = s3.New(sess)
+	s.db = dynamodb.New(sess)
+	return nil
+}
+
+// Load implements infra.StateStore.
+func (s *S3Store) Load() ([]byte, string, error) {
+	out, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key),
+	})
+	if isNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+	p, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return p, aws.StringValue(out.ETag), nil
+}
+
+// Save implements infra.StateStore.
+func (s *S3Store) Save(p []byte, rev string) (string, error) {
+	var current string
+	head, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key),
+	})
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return "", err
+	default:
+		current = aws.StringValue(head.ETag)
+	}
+	if current != rev {
+		return "", infra.ErrRevisionMismatch
+	}
+	out, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key),
+		Body:   bytes.NewReader(p),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// Lock implements infra.StateStore.
+func (s *S3Store) Lock() error {
+	if s.LockTable == "" {
+		return errors.New("aws.S3Store: no lock table specified")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != "" {
+		return infra.ErrLocked
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	owner := hex.EncodeToString(b[:])
+	_, err := s.db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.LockTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(s.lockID())},
+			"Owner":  {S: aws.String(owner)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return infra.ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+	s.owner = owner
+	return nil
+}
+
+// Unlock implements infra.StateStore.
+func (s *S3Store) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == "" {
+		return errors.New("aws.S3Store: not locked")
+	}
+	_, err := s.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.LockTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(s.lockID())},
+		},
+		ConditionExpression:       aws.String("Owner = :owner"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(s.owner)}},
+	})
+	if err != nil {
+		return fmt.Errorf("aws.S3Store: unlock: %v", err)
+	}
+	s.owner = ""
+	return nil
+}
+
+func (s *S3Store) lockID() string {
+	return s.Bucket + "/" + s.Key
+}
+
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/grailbio/infra"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func etag(p []byte) *string {
+	sum := md5.Sum(p)
+	return aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)
+}
+
+func (s *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	p, ok := s.objects[*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(p)), ETag: etag(p)}, nil
+}
+
+func (s *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	p, ok := s.objects[*in.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{ETag: etag(p)}, nil
+}
+
+func (s *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	p, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.objects[*in.Key] = p
+	return &s3.PutObjectOutput{ETag: etag(p)}, nil
+}
+
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	locks map[string]string
+}
+
+func (d *fakeDynamoDB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	id := *in.Item["LockID"].S
+	if _, ok := d.locks[id]; ok {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conditional check failed", nil)
+	}
+	d.locks[id] = *in.Item["Owner"].S
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *fakeDynamoDB) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	id := *in.Key["LockID"].S
+	if d.locks[id] != *in.ExpressionAttributeValues[":owner"].S {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conditional check failed", nil)
+	}
+	delete(d.locks, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestS3Store(t *testing.T) {
+	var (
+		fs3 = &fakeS3{objects: make(map[string][]byte)}
+		fdb = &fakeDynamoDB{locks: make(map[string]string)}
+	)
+	newStore := func() *S3Store {
+		return &S3Store{Bucket: "bucket", Key: "config", LockTable: "locks", s3: fs3, db: fdb}
+	}
+	store1, store2 := newStore(), newStore()
+	p, rev, err := store1.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != nil || rev != "" {
+		t.Errorf("got %q, %q, want empty", p, rev)
+	}
+	if err := store1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store2.Lock(), infra.ErrLocked; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	rev, err = store1.Save([]byte("one"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store1.Save([]byte("two"), ""); err != infra.ErrRevisionMismatch {
+		t.Errorf("got %v, want %v", err, infra.ErrRevisionMismatch)
+	}
+	if _, err := store1.Save([]byte("two"), rev); err != nil {
+		t.Fatal(err)
+	}
+	if err := store1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store2.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	p, _, err = store2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), "two"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := store2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package cli implements the infra command, which manages
+// configurations stored in YAML files. The command is pluggable:
+// projects link their own providers into a binary whose main
+// function calls Main (or Command.Run) with the project's schema.
+// Package github.com/grailbio/infra/cmd/infra provides a default
+// binary that links the providers of this repository.
+//
+// The command's usage is:
+//
+//	infra [-config path] command [arguments]
+//
+// where command is one of:
+//
+//	init            write a new configuration by asking for its parameters
+//	validate        check that the configuration is well-formed
+//	plan            show the setup steps that setup would perform
+//	setup           perform setup, saving the configuration after each step
+//	teardown        tear down the set up infrastructure
+//	help [key]      show help for the providers of a key (or all keys)
+//	graph           write the dependency graph in Graphviz DOT format
+//	diff path       show the differences to the configuration at path
+//	show [-redact]  write the configuration, with secrets masked if -redact
+//	get path        write the value at the dot-separated path of keys
+//
+// Eager providers (see infra.Register) are initialized when the
+// configuration is loaded, except by the commands that only inspect
+// it: validate, plan, help, graph, diff, show, and get.
+//
+// The command exits with ExitOK on success, ExitError on failure, and
+// ExitUsage on usage errors. The diff command exits with ExitError
+// if the configurations differ.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/infra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Exit codes returned by Command.Run.
+const (
+	ExitOK    = 0
+	ExitError = 1
+	ExitUsage = 2
+)
+
+// DefaultConfig is the path of the configuration file used if none
+// is provided with the -config flag.
+const DefaultConfig = "infra.yaml"
+
+// errUsage is returned by commands that are invoked incorrectly.
+var errUsage = errors.New("usage error")
+
+// errDiffer is returned by the diff command if the configurations
+// differ.
+var errDiffer = errors.New("configurations differ")
+
+// A Command is an infra command for configurations of a schema.
+type Command struct {
+	// Schema is the schema of the managed configurations.
+	Schema infra.Schema
+	// Registry is the registry in which providers are looked up. If
+	// nil, infra.DefaultRegistry is used.
+	Registry *infra.Registry
+	// Stdin is the input from which the init command reads answers.
+	// If nil, os.Stdin is used.
+	Stdin io.Reader
+	// Stdout and Stderr are the command's output and error streams.
+	// If nil, os.Stdout and os.Stderr are used.
+	Stdout, Stderr io.Writer
+}
+
+// Main runs the infra command for the provided schema with the
+// process's arguments and exits with the command's exit code.
+func Main(schema infra.Schema) {
+	cmd := Command{Schema: schema}
+	os.Exit(cmd.Run(os.Args[1:]))
+}
+
+// Run runs the command with the provided arguments, not including
+// the program name, and returns its exit code.
+func (cmd Command) Run(args []string) int {
+	if cmd.Registry == nil {
+		cmd.Registry = infra.DefaultRegistry
+	}
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	flags := flag.NewFlagSet("infra", flag.ContinueOnError)
+	flags.SetOutput(cmd.Stderr)
+	path := flags.String("config", DefaultConfig, "path of the configuration file")
+	flags.Usage = func() { cmd.usage(flags) }
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if flags.NArg() == 0 {
+		cmd.usage(flags)
+		return ExitUsage
+	}
+	var run func(path string, args []string) error
+	switch name := flags.Arg(0); name {
+	case "init":
+		run = cmd.init
+	case "validate":
+		run = cmd.validate
+	case "plan":
+		run = cmd.plan
+	case "setup":
+		run = cmd.setup
+	case "teardown":
+		run = cmd.teardown
+	case "help":
+		run = cmd.help
+	case "graph":
+		run = cmd.graph
+	case "diff":
+		run = cmd.diff
+	case "show":
+		run = cmd.show
+	case "get":
+		run = cmd.get
+	default:
+		fmt.Fprintf(cmd.Stderr, "infra: unknown command %s\n", name)
+		cmd.usage(flags)
+		return ExitUsage
+	}
+	switch err := run(*path, flags.Args()[1:]); err {
+	case nil:
+		return ExitOK
+	case errUsage:
+		cmd.usage(flags)
+		return ExitUsage
+	case errDiffer:
+		return ExitError
+	default:
+		fmt.Fprintf(cmd.Stderr, "infra %s: %v\n", flags.Arg(0), err)
+		return ExitError
+	}
+}
+
+func (cmd Command) usage(flags *flag.FlagSet) {
+	fmt.Fprint(cmd.Stderr, `usage: infra [-config path] command [arguments]
+
+Commands:
+	init            write a new configuration by asking for its parameters
+	validate        check that the configuration is well-formed
+	plan            show the setup steps that setup would perform
+	setup           perform setup, saving the configuration after each step
+	teardown        tear down the set up infrastructure
+	help [key]      show help for the providers of a key (or all keys)
+	graph           write the dependency graph in Graphviz DOT format
+	diff path       show the differences to the configuration at path
+	show [-redact]  write the configuration, with secrets masked if -redact
+	get path        write the value at the dot-separated path of keys
+
+Flags:
+`)
+	flags.PrintDefaults()
+}
+
+// load loads the configuration at the provided path, initializing
+// its eager instances.
+func (cmd Command) load(path string) (infra.Config, error) {
+	return cmd.loadWith(path, cmd.Schema.UnmarshalWithRegistry)
+}
+
+// inspect loads the configuration at the provided path without
+// initializing its eager instances, for commands that only inspect
+// the configuration.
+func (cmd Command) inspect(path string) (infra.Config, error) {
+	return cmd.loadWith(path, cmd.Schema.UnmarshalLazyWithRegistry)
+}
+
+func (cmd Command) loadWith(path string, unmarshal func(*infra.Registry, []byte) (infra.Config, error)) (infra.Config, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return infra.Config{}, err
+	}
+	config, err := unmarshal(cmd.Registry, p)
+	if err != nil {
+		return infra.Config{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (cmd Command) init(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	p, err := cmd.Schema.InteractiveWithRegistry(cmd.Registry, cmd.Stdin, cmd.Stdout)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, p); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "wrote %s\n", path)
+	return nil
+}
+
+func (cmd Command) validate(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if _, err := cmd.inspect(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%s: ok\n", path)
+	return nil
+}
+
+func (cmd Command) plan(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	steps := config.Plan()
+	if len(steps) == 0 {
+		fmt.Fprintln(cmd.Stdout, "nothing to set up")
+		return nil
+	}
+	for _, step := range steps {
+		if step.FromVersion < 0 {
+			fmt.Fprintf(cmd.Stdout, "%s: set up %s (version %d)\n", step.Key, step.Provider, step.ToVersion)
+		} else {
+			fmt.Fprintf(cmd.Stdout, "%s: upgrade %s (version %d -> %d)\n", step.Key, step.Provider, step.FromVersion, step.ToVersion)
+		}
+	}
+	return nil
+}
+
+func (cmd Command) setup(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	config, err := cmd.load(path)
+	if err != nil {
+		return err
+	}
+	return config.SetupPersist(infra.PersisterFunc(func(p []byte) error {
+		return writeFile(path, p)
+	}))
+}
+
+func (cmd Command) teardown(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	config, err := cmd.load(path)
+	if err != nil {
+		return err
+	}
+	teardownErr := config.Teardown()
+	// Save the configuration even if teardown fails, so that the
+	// instances that were torn down are recorded.
+	p, err := config.Marshal(false)
+	if err != nil {
+		return err
+	}
+	if p, err = withInstances(p, path); err != nil {
+		return err
+	}
+	if err := writeFile(path, p); err != nil {
+		return err
+	}
+	return teardownErr
+}
+
+func (cmd Command) help(path string, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	help := config.Help()
+	if len(args) == 1 {
+		usages, ok := help[args[0]]
+		if !ok {
+			return fmt.Errorf("no key named %s", args[0])
+		}
+		help = map[string][]infra.Usage{args[0]: usages}
+	}
+	return infra.WriteHelp(cmd.Stdout, help)
+}
+
+func (cmd Command) graph(path string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	return config.WriteGraph(cmd.Stdout)
+}
+
+func (cmd Command) diff(path string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	other, err := cmd.inspect(args[0])
+	if err != nil {
+		return err
+	}
+	diff, err := config.Diff(other)
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		return nil
+	}
+	fmt.Fprint(cmd.Stdout, diff)
+	return errDiffer
+}
+
+func (cmd Command) show(path string, args []string) error {
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	flags.SetOutput(cmd.Stderr)
+	redact := flags.Bool("redact", false, "mask sensitive values")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	var p []byte
+	if *redact {
+		p, err = config.MarshalRedacted()
+	} else {
+		p, err = config.Marshal(false)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cmd.Stdout.Write(p)
+	return err
+}
+
+func (cmd Command) get(path string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	config, err := cmd.inspect(path)
+	if err != nil {
+		return err
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		return err
+	}
+	if p, err = withInstances(p, path); err != nil {
+		return err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	for _, elem := range strings.Split(args[0], ".") {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("%s not defined", args[0])
+		}
+		if v, ok = m[elem]; !ok {
+			return fmt.Errorf("%s not defined", args[0])
+		}
+	}
+	switch v.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		p, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = cmd.Stdout.Write(p)
+		return err
+	default:
+		_, err := fmt.Fprintln(cmd.Stdout, v)
+		return err
+	}
+}
+
+// withInstances returns the marshaled configuration p with the
+// instance configurations stored in the configuration file at path,
+// so that they may be read, and are retained when the file is
+// rewritten, without initializing the instances in order to marshal
+// them.
+func withInstances(p []byte, path string) ([]byte, error) {
+	stored, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var storedKeys map[string]interface{}
+	if err := yaml.Unmarshal(stored, &storedKeys); err != nil {
+		return nil, err
+	}
+	instances, ok := storedKeys["instances"]
+	if !ok {
+		return p, nil
+	}
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(p, &keys); err != nil {
+		return nil, err
+	}
+	keys["instances"] = instances
+	return yaml.Marshal(keys)
+}
+
+// writeFile atomically replaces the file at path with p.
+func writeFile(path string, p []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		if err := os.Chmod(f.Name(), info.Mode()); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,290 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cli_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/infra/cli"
+	"github.com/grailbio/testutil"
+)
+
+type creds struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password" infra:"secret"`
+}
+
+func (c *creds) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&c.User, "user", "", "user name")
+}
+
+func (c *creds) Config() interface{} { return c }
+func (*creds) Help() string          { return "test credentials" }
+
+type cluster struct {
+	Owner string `yaml:"owner"`
+}
+
+func (c *cluster) Setup(creds *creds) error {
+	c.Owner = creds.User
+	return nil
+}
+
+func (c *cluster) Teardown() error {
+	c.Owner = ""
+	return nil
+}
+
+func (c *cluster) Config() interface{} { return c }
+func (*cluster) Version() int          { return 1 }
+
+// conn is an eager provider whose initialization always fails.
+type conn struct{}
+
+func (*conn) Init() error { return errors.New("connection refused") }
+func (*conn) Eager() bool { return true }
+
+var (
+	registry = infra.NewRegistry()
+	schema   = infra.Schema{
+		"creds":   new(creds),
+		"cluster": new(cluster),
+	}
+)
+
+func init() {
+	registry.Register("testcreds", new(creds))
+	registry.Register("testcluster", new(cluster))
+	registry.Register("testconn", new(conn))
+	infra.RegisterBuiltins(registry)
+}
+
+// run runs the infra command with the provided arguments, returning
+// its exit code and output.
+func run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	return runSchema(t, schema, args...)
+}
+
+// runSchema runs the infra command for the provided schema.
+func runSchema(t *testing.T, schema infra.Schema, args ...string) (int, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := cli.Command{Schema: schema, Registry: registry, Stdout: &stdout, Stderr: &stderr}
+	code := cmd.Run(args)
+	return code, stdout.String() + stderr.String()
+}
+
+// writeConfig writes the provided configuration to a new file in
+// the directory dir, returning its path.
+func writeConfig(t *testing.T, dir, config string) string {
+	t.Helper()
+	f, err := ioutil.TempFile(dir, "infra*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestCommand(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := writeConfig(t, dir, `creds: testcreds,user=xyz
+cluster: testcluster
+`)
+	for _, c := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"validate"}, cli.ExitOK, path + ": ok\n"},
+		{[]string{"plan"}, cli.ExitOK, "cluster: set up testcluster (version 1)\n"},
+		{[]string{"get", "creds"}, cli.ExitOK, "testcreds,user=xyz\n"},
+		{[]string{"get", "testcreds.bogus"}, cli.ExitError, "infra get: testcreds.bogus not defined\n"},
+		{[]string{"graph"}, cli.ExitOK, `digraph infra {
+	"cluster (testcluster)";
+	"creds (testcreds)";
+	"cluster (testcluster)" -> "creds (testcreds)";
+}
+`},
+		{[]string{"help", "bogus"}, cli.ExitError, "infra help: no key named bogus\n"},
+		{[]string{"bogus"}, cli.ExitUsage, "infra: unknown command bogus\nusage:"},
+		{[]string{"get"}, cli.ExitUsage, "usage:"},
+		{nil, cli.ExitUsage, "usage:"},
+	} {
+		code, out := run(t, append([]string{"-config", path}, c.args...)...)
+		if code != c.code {
+			t.Errorf("%v: got exit code %v, want %v", c.args, code, c.code)
+		}
+		if !strings.HasPrefix(out, c.out) {
+			t.Errorf("%v: got %q, want %q", c.args, out, c.out)
+		}
+	}
+	code, out := run(t, "-config", path, "help", "creds")
+	if code != cli.ExitOK || !strings.Contains(out, "test credentials") {
+		t.Errorf("got %v, %q", code, out)
+	}
+	code, out = run(t, "-config", filepath.Join(dir, "missing.yaml"), "validate")
+	if code != cli.ExitError || !strings.Contains(out, "no such file") {
+		t.Errorf("got %v, %q", code, out)
+	}
+	bad := writeConfig(t, dir, "creds: bogus\n")
+	if code, _ := run(t, "-config", bad, "validate"); code != cli.ExitError {
+		t.Errorf("got %v, want %v", code, cli.ExitError)
+	}
+}
+
+func TestCommandSetup(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := writeConfig(t, dir, `creds: testcreds,user=xyz
+cluster: testcluster
+testcluster:
+  owner: ""
+`)
+	other := writeConfig(t, dir, `creds: testcreds,user=xyz
+cluster: testcluster
+`)
+	if code, out := run(t, "-config", path, "diff", other); code != cli.ExitOK || out != "" {
+		t.Errorf("got %v, %q", code, out)
+	}
+	if code, out := run(t, "-config", path, "setup"); code != cli.ExitOK {
+		t.Fatalf("setup: got %v, %q", code, out)
+	}
+	if code, out := run(t, "-config", path, "get", "testcluster.owner"); code != cli.ExitOK || out != "xyz\n" {
+		t.Errorf("got %v, %q", code, out)
+	}
+	if code, out := run(t, "-config", path, "plan"); code != cli.ExitOK || out != "nothing to set up\n" {
+		t.Errorf("got %v, %q", code, out)
+	}
+	code, out := run(t, "-config", other, "diff", path)
+	if code != cli.ExitError {
+		t.Errorf("got %v, want %v", code, cli.ExitError)
+	}
+	for _, want := range []string{"-  owner: \"\"\n", "+  owner: xyz\n", "+  testcluster: 1\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff %q does not contain %q", out, want)
+		}
+	}
+	if code, out := run(t, "-config", path, "teardown"); code != cli.ExitOK {
+		t.Fatalf("teardown: got %v, %q", code, out)
+	}
+	if code, out := run(t, "-config", path, "plan"); code != cli.ExitOK || out != "cluster: set up testcluster (version 1)\n" {
+		t.Errorf("got %v, %q", code, out)
+	}
+}
+
+func TestCommandShow(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := writeConfig(t, dir, `creds: testcreds,user=xyz
+cluster: testcluster
+testcreds:
+  password: hunter2
+`)
+	code, out := run(t, "-config", path, "show")
+	if code != cli.ExitOK || !strings.Contains(out, "password: hunter2") {
+		t.Errorf("got %v, %q", code, out)
+	}
+	code, out = run(t, "-config", path, "show", "-redact")
+	if code != cli.ExitOK || strings.Contains(out, "hunter2") {
+		t.Errorf("got %v, %q", code, out)
+	}
+	if code, _ := run(t, "-config", path, "show", "extra"); code != cli.ExitUsage {
+		t.Errorf("got %v, want %v", code, cli.ExitUsage)
+	}
+}
+
+func TestCommandInit(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "infra.yaml")
+	var stdout, stderr bytes.Buffer
+	cmd := cli.Command{
+		Schema:   schema,
+		Registry: registry,
+		Stdin:    strings.NewReader("\ntestcreds\nabc\n"),
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+	}
+	if code := cmd.Run([]string{"-config", path, "init"}); code != cli.ExitOK {
+		t.Fatalf("init: got %v, %q", code, stderr.String())
+	}
+	if code, out := run(t, "-config", path, "get", "creds"); code != cli.ExitOK || out != "testcreds,user=abc\n" {
+		t.Errorf("got %v, %q", code, out)
+	}
+	if code, out := run(t, "-config", path, "init"); code != cli.ExitError || !strings.Contains(out, "already exists") {
+		t.Errorf("got %v, %q", code, out)
+	}
+}
+
+func TestCommandEager(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	schema := infra.Schema{
+		"creds": new(creds),
+		"conn":  new(conn),
+	}
+	path := writeConfig(t, dir, `creds: testcreds,user=xyz
+conn: testconn
+`)
+	// Commands that only inspect the configuration do not
+	// initialize eager providers.
+	for _, args := range [][]string{
+		{"validate"},
+		{"plan"},
+		{"get", "creds"},
+		{"graph"},
+		{"help"},
+	} {
+		if code, out := runSchema(t, schema, append([]string{"-config", path}, args...)...); code != cli.ExitOK {
+			t.Errorf("%v: got %v, %q", args, code, out)
+		}
+	}
+	code, out := runSchema(t, schema, "-config", path, "setup")
+	if code != cli.ExitError || !strings.Contains(out, "connection refused") {
+		t.Errorf("got %v, %q", code, out)
+	}
+}
+
+func TestCommandInstances(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := writeConfig(t, dir, `creds: testcreds,user=xyz
+cluster: testcluster
+instances:
+  zzca:
+    v: precious-private-key
+`)
+	const want = "instances:\n  zzca:\n    v: precious-private-key\n"
+	for _, command := range []string{"setup", "teardown"} {
+		if code, out := run(t, "-config", path, command); code != cli.ExitOK {
+			t.Fatalf("%s: got %v, %q", command, code, out)
+		}
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(p), want) {
+			t.Errorf("%s: config %s does not contain %q", command, p, want)
+		}
+		if code, out := run(t, "-config", path, "get", "instances.zzca.v"); code != cli.ExitOK || out != "precious-private-key\n" {
+			t.Errorf("%s: got %v, %q", command, code, out)
+		}
+	}
+}
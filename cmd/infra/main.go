@@ -0,0 +1,29 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command infra manages infra configurations with the providers of
+// this repository, as well as plugin providers (see infra.Plugin).
+// Projects that need their own providers should link them into
+// their own binary and call cli.Main with their schema. See package
+// github.com/grailbio/infra/cli for usage.
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/infra"
+	_ "github.com/grailbio/infra/aws"
+	"github.com/grailbio/infra/cli"
+	_ "github.com/grailbio/infra/ec2metadata"
+	"github.com/grailbio/infra/tls"
+)
+
+var schema = infra.Schema{
+	"session": new(session.Session),
+	"tls":     new(tls.Certs),
+	"plugin":  new(infra.Plugin),
+}
+
+func main() {
+	cli.Main(schema)
+}
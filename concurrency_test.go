@@ -0,0 +1,197 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/infra"
+)
+
+// TestConcurrency exercises concurrent use of a single config. It is
+// most useful when run with the race detector.
+func TestConcurrency(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=concurrent",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const N = 20
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 4*N)
+	)
+	for i := 0; i < N; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			var cluster *testCluster
+			if err := config.Instance(&cluster); err != nil {
+				errs <- err
+				return
+			}
+			if got, want := cluster.User, "concurrent"; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := config.Marshal(true); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := config.MarshalRedacted(); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := config.Setup(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	var cluster *testCluster
+	config.Must(&cluster)
+	if got, want := cluster.SetupUser, "concurrent"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// reentrantConfig is the config used by testReentrant's Init method.
+var reentrantConfig infra.Config
+
+type testReentrant struct {
+	User string
+}
+
+func (r *testReentrant) Init() error {
+	var creds *testCreds
+	if err := reentrantConfig.Instance(&creds); err != nil {
+		return err
+	}
+	r.User = creds.User()
+	return nil
+}
+
+func (r *testReentrant) InstanceConfig() interface{} { return r }
+
+// testReentrantUser requires testReentrant in each of its methods.
+type testReentrantUser struct{}
+
+func (*testReentrantUser) Setup(r *testReentrant) error             { return nil }
+func (*testReentrantUser) Teardown(r *testReentrant) error          { return nil }
+func (*testReentrantUser) Import(id string, r *testReentrant) error { return nil }
+func (*testReentrantUser) Refresh(r *testReentrant) (bool, string, error) {
+	return true, "drifted", nil
+}
+
+func init() {
+	infra.Register("testreentrant", new(testReentrant))
+	infra.Register("testreentrantuser", new(testReentrantUser))
+}
+
+// TestReentrant makes sure that provider Init methods may use the
+// config that initializes them.
+func TestReentrant(t *testing.T) {
+	schema := infra.Schema{
+		"creds":     new(testCreds),
+		"reentrant": new(testReentrant),
+	}
+	var err error
+	reentrantConfig, err = schema.Make(infra.Keys{
+		"creds":     "testcreds,user=reentrant",
+		"reentrant": "testreentrant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		if _, err := reentrantConfig.Marshal(true); err != nil {
+			done <- err
+			return
+		}
+		var r *testReentrant
+		if err := reentrantConfig.Instance(&r); err != nil {
+			done <- err
+			return
+		}
+		if got, want := r.User, "reentrant"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("deadlock")
+	}
+}
+
+// TestReentrantRequirements makes sure that the requirements of
+// Setup, Refresh, Import, and Teardown may use the config in their
+// Init methods.
+func TestReentrantRequirements(t *testing.T) {
+	schema := infra.Schema{
+		"creds":     new(testCreds),
+		"reentrant": new(testReentrant),
+		"user":      new(testReentrantUser),
+	}
+	for _, c := range []struct {
+		name string
+		op   func(infra.Config) error
+	}{
+		{"setup", infra.Config.Setup},
+		{"refresh", func(config infra.Config) error {
+			_, err := config.Refresh(true)
+			return err
+		}},
+		{"import", func(config infra.Config) error {
+			return config.Import("user", "id")
+		}},
+		{"teardown", func(config infra.Config) error {
+			if err := config.Setup(); err != nil {
+				return err
+			}
+			return config.Teardown()
+		}},
+	} {
+		var err error
+		reentrantConfig, err = schema.Make(infra.Keys{
+			"creds":     "testcreds,user=reentrant",
+			"reentrant": "testreentrant",
+			"user":      "testreentrantuser",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() { done <- c.op(reentrantConfig) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("%s: deadlock", c.name)
+		}
+	}
+}
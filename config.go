@@ -16,7 +16,7 @@
 // values directly from the configuration: the details of configuration
 // and of managing dependencies between infrastructure components is
 // handled by the config object itself. Configurations are marshaled and
-// must be stored by the user.
+// must be stored by the user, either directly or through a StateStore.
 //
 // Infrastructure migration is handled by maintaining a set of versions
 // for each provider; migrations perform side-effects and can modify the
@@ -25,12 +25,16 @@
 package infra
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -54,7 +58,7 @@ import (
 //	}
 //
 // Schemas must be bijective: multiple keys cannot map to the same
-// type.
+// type. The key "infra" is reserved.
 type Schema map[string]interface{}
 
 // Make builds a new configuration based on the Schema s with the
@@ -75,24 +79,62 @@ type Schema map[string]interface{}
 // - the provider type is a struct (or pointer to struct) that
 // contains an embedded field   that is assignable to the schema
 // type.
+//
+// Instances whose providers are eager (see Register) are initialized
+// by Make; their initialization errors are returned together as an
+// *InitError.
 func (s Schema) Make(keys Keys) (Config, error) {
+	return s.MakeWithRegistry(DefaultRegistry, keys)
+}
+
+// MakeWithRegistry builds a new configuration as in Make, looking
+// up providers in the registry reg instead of DefaultRegistry.
+func (s Schema) MakeWithRegistry(reg *Registry, keys Keys) (Config, error) {
+	config, err := s.make(reg, keys)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := config.initAll(context.Background(), (*instance).Eager); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// make builds a new configuration as in MakeWithRegistry, without
+// initializing eager instances.
+func (s Schema) make(reg *Registry, keys Keys) (Config, error) {
+	if err := s.checkReserved(); err != nil {
+		return Config{}, err
+	}
 	keys = keys.Clone()
 	config := Config{
-		Keys:      keys,
-		schema:    s,
-		types:     s.types(),
-		versions:  make(map[string]int),
-		instances: make(map[reflect.Type]*instance),
+		registry:    reg,
+		Keys:        keys,
+		schema:      s,
+		types:       s.types(),
+		versions:    make(map[string]int),
+		instances:   make(map[reflect.Type]*instance),
+		outputs:     make(map[reflect.Type]*instance),
+		mu:          new(sync.RWMutex),
+		retryPolicy: new(atomic.Value),
+		observer:    new(atomic.Value),
+		audit:       new(auditLog),
 	}
 	config.typeset = make([]reflect.Type, 0, len(config.types))
 	for k := range config.types {
 		config.typeset = append(config.typeset, k)
 	}
+	if err := config.resolveAliases(); err != nil {
+		return Config{}, err
+	}
 	if v := keys["versions"]; v != nil {
 		if err := remarshal(v, config.versions); err != nil {
 			return Config{}, err
 		}
 	}
+	if err := config.audit.load(keys); err != nil {
+		return Config{}, err
+	}
 	if err := config.build(); err != nil {
 		return Config{}, err
 	}
@@ -100,18 +142,103 @@ func (s Schema) Make(keys Keys) (Config, error) {
 }
 
 // Unmarshal unmarshals the configuration keys in the YAML-formatted
-// byte buffer p. The configuration is then initialized with Make.
+// byte buffer p. The keys are migrated to the schema's current
+// format version (see Schema.RegisterMigration), references in
+// their values are interpolated, and the configuration is then
+// initialized with Make.
+//
+// String values, including provider strings and the values in
+// provider configurations, may contain references of the following
+// forms:
+//
+//	${env:NAME}         the value of the environment variable NAME
+//	${key:path}         the value at the dot-separated path of keys,
+//	                    e.g., ${key:region} or ${key:mycluster.size}
+//	${output:key.path}  the value at path in the outputs of the
+//	                    provider configured for the schema key key
+//
+// A literal "${" is written as "$${". A value that consists only of
+// a reference takes on the referenced value, including its type.
+// References are resolved recursively; reference cycles are
+// reported as errors. When the configuration is marshaled, values
+// that still equal their interpolated values are marshaled with
+// their references (and escapes) intact, so that, for example,
+// environment variables are not persisted. Values in lists, values
+// changed by setup, and encrypted secrets are marshaled as they are.
 func (s Schema) Unmarshal(p []byte) (Config, error) {
+	return s.UnmarshalWithRegistry(DefaultRegistry, p)
+}
+
+// UnmarshalWithRegistry unmarshals a configuration as in Unmarshal,
+// looking up providers in the registry reg instead of
+// DefaultRegistry.
+func (s Schema) UnmarshalWithRegistry(reg *Registry, p []byte) (Config, error) {
+	config, err := s.unmarshal(reg, p)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := config.initAll(context.Background(), (*instance).Eager); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// UnmarshalLazy unmarshals a configuration as in Unmarshal, but
+// does not initialize eager instances: as with other instances,
+// they are initialized when they are first needed. UnmarshalLazy is
+// useful for inspecting configurations (e.g., to plan, show, or
+// diff them) without acting on them.
+func (s Schema) UnmarshalLazy(p []byte) (Config, error) {
+	return s.UnmarshalLazyWithRegistry(DefaultRegistry, p)
+}
+
+// UnmarshalLazyWithRegistry unmarshals a configuration as in
+// UnmarshalLazy, looking up providers and migrations in the
+// registry reg instead of DefaultRegistry.
+func (s Schema) UnmarshalLazyWithRegistry(reg *Registry, p []byte) (Config, error) {
+	return s.unmarshal(reg, p)
+}
+
+// unmarshal unmarshals a configuration as in UnmarshalWithRegistry,
+// without initializing eager instances.
+func (s Schema) unmarshal(reg *Registry, p []byte) (Config, error) {
 	keys := make(Keys)
 	if err := yaml.Unmarshal(p, keys); err != nil {
 		return Config{}, err
 	}
-	return s.Make(keys)
+	keys, err := s.migrate(keys)
+	if err != nil {
+		return Config{}, err
+	}
+	refs, err := interpolate(keys)
+	if err != nil {
+		return Config{}, err
+	}
+	config, err := s.make(reg, keys)
+	if err != nil {
+		return Config{}, err
+	}
+	config.refs = refs
+	return config, nil
 }
 
+// checkReserved returns an error if the schema uses the reserved key
+// "infra", under which configuration metadata is stored.
+func (s Schema) checkReserved() error {
+	if _, ok := s[infraKey]; ok {
+		return fmt.Errorf("schema key %s is reserved", infraKey)
+	}
+	return nil
+}
+
+// types returns the schema's keys, indexed by their types. The
+// reserved key "infra" is skipped; see checkReserved.
 func (s Schema) types() map[reflect.Type]string {
 	types := make(map[reflect.Type]string)
 	for k, zero := range s {
+		if k == infraKey {
+			continue
+		}
 		typ := reflect.TypeOf(zero)
 		if typ.Kind() == reflect.Ptr && typ.Elem().Kind() == reflect.Interface {
 			typ = typ.Elem()
@@ -129,16 +256,55 @@ func (s Schema) types() map[reflect.Type]string {
 // performs validation. Configurations are responsible for mapping
 // and configuring concrete instances into the types specified by the
 // schema.
+//
+// Configs (and their copies) are safe for concurrent use. Operations
+// that only instantiate values (Instance, Must, and Output) or that
+// describe the config (Help) may proceed concurrently with each
+// other. Operations that perform setup or that marshal provider
+// state (Marshal, MarshalRedacted, Setup, SetupPersist,
+// SetupAndSave, Refresh, and Import) are exclusive: they wait for
+// concurrent operations to complete, and block other operations
+// until they are done. Provider Init methods are called without
+// holding the config's lock, so that they may themselves use the
+// config; each instance is still initialized at most once. (The
+// values required by Setup, Refresh, Import, and Teardown are thus
+// initialized before the lock is acquired.) Provider Setup,
+// Refresh, Import, and Teardown methods, however, may not use the
+// config.
+//
+// The embedded Keys must not be modified once the config is
+// created. Access to the embedded Keys is not synchronized: its
+// values may be modified by exclusive operations, and so it may not
+// be read concurrently with them.
 type Config struct {
 	Keys
 	schema Schema
 
+	// mu serializes setup and marshaling with respect to value
+	// instantiation; it is shared among copies of the config.
+	mu *sync.RWMutex
+	// retryPolicy holds the config's RetryPolicy; it is shared
+	// among copies of the config.
+	retryPolicy *atomic.Value
+	// observer holds the config's Observer; it is shared among
+	// copies of the config.
+	observer *atomic.Value
+	// registry is the registry in which providers are looked up.
+	registry *Registry
+	// audit is the config's audit log; it is shared among copies of
+	// the config.
+	audit *auditLog
+
 	types     map[reflect.Type]string
 	instances map[reflect.Type]*instance
+	outputs   map[reflect.Type]*instance
 	order     []*instance
 	typeset   []reflect.Type
 
 	versions map[string]int
+	// refs are the values interpolated by Schema.Unmarshal, whose
+	// raw values are restored when the config is marshaled.
+	refs []reference
 }
 
 // Flag is a provider flag.
@@ -151,6 +317,25 @@ type Flag struct {
 	Help string
 }
 
+// Field describes a field of a provider's configuration, as
+// returned by its Config method.
+type Field struct {
+	// Name is the YAML name of the field.
+	Name string
+	// Type is the Go type of the field.
+	Type string
+}
+
+// Dependency describes a value required by a provider's Init or
+// Setup method.
+type Dependency struct {
+	// Type is the type of the required value.
+	Type string
+	// Key is the schema key that provides the value, or empty if
+	// no key in the schema provides it.
+	Key string
+}
+
 // Usage contains the usage information of the provider
 type Usage struct {
 	// Name of the provider.
@@ -159,30 +344,78 @@ type Usage struct {
 	Usage string
 	// Args to the provider.
 	Args []Flag
+	// Config lists the fields of the provider's configuration.
+	Config []Field
+	// Init lists the values required by the provider's Init method.
+	Init []Dependency
+	// Setup lists the values required by the provider's Setup method.
+	Setup []Dependency
+	// Version is the provider's current version.
+	Version int
+	// InstanceConfig tells whether the provider's instances can
+	// be marshaled.
+	InstanceConfig bool
 }
 
-// Help returns Usages, organized by schema keys.
+// Help returns Usages, organized by schema keys. Each key's usages
+// are ordered by provider name.
 func (c Config) Help() map[string][]Usage {
+	defer c.rlock()()
 	usage := make(map[string][]Usage)
 	for typ, key := range c.types {
-		for k, p := range providers {
+		for _, p := range c.registry.registered() {
 			field, ok := assign(p.Type(), typ)
 			if !ok {
 				continue
 			}
-			inst := p.New(c, field)
-			flags := inst.Flags()
-			u := Usage{Name: k, Usage: inst.Help()}
-			flags.VisitAll(func(f *flag.Flag) {
-				arg := Flag{f.Name, f.DefValue, f.Usage}
-				u.Args = append(u.Args, arg)
-			})
-			usage[key] = append(usage[key], u)
+			usage[key] = append(usage[key], c.usage(p.New(c, field)))
 		}
 	}
 	return usage
 }
 
+func (c Config) usage(inst *instance) Usage {
+	u := Usage{
+		Name:           inst.Impl(),
+		Usage:          inst.Help(),
+		Init:           c.dependencies(inst.RequiresInit()),
+		Setup:          c.dependencies(inst.RequiresSetup()),
+		Version:        inst.Version(),
+		InstanceConfig: inst.HasInstanceConfig(),
+	}
+	inst.Flags().VisitAll(func(f *flag.Flag) {
+		u.Args = append(u.Args, Flag{f.Name, f.DefValue, f.Usage})
+	})
+	if config := inst.Config(); config != nil {
+		typ := reflect.TypeOf(config)
+		if fields := configFields(typ); fields != nil {
+			for _, f := range fields {
+				u.Config = append(u.Config, Field{f.Name, f.Type.String()})
+			}
+		} else {
+			for typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			u.Config = []Field{{Type: typ.String()}}
+		}
+	}
+	return u
+}
+
+func (c Config) dependencies(types []reflect.Type) []Dependency {
+	if len(types) == 0 {
+		return nil
+	}
+	deps := make([]Dependency, len(types))
+	for i, typ := range types {
+		deps[i].Type = typ.String()
+		if match, err := assignUnique(typ, c.typeset); err == nil {
+			deps[i].Key = c.types[match]
+		}
+	}
+	return deps
+}
+
 // Instance stores the configuration-managed instance into the
 // provided pointer. Instance panics if ptr is not pointer-typed.
 // Instance returns an error if no providers are configured for the
@@ -192,11 +425,13 @@ func (c Config) Instance(ptr interface{}) error {
 	if vptr.Kind() != reflect.Ptr {
 		panic("infra.Instance: non-pointer argument")
 	}
+	unlock := c.rlock()
 	typ, err := assignUnique(vptr.Type().Elem(), c.typeset)
+	inst := c.instances[typ]
+	unlock()
 	if err != nil {
 		return err
 	}
-	inst := c.instances[typ]
 	if inst == nil {
 		_, file, line, _ := runtime.Caller(1)
 		return fmt.Errorf("no providers for type %s (%s:%d)", vptr.Type().Elem(), file, line)
@@ -212,6 +447,9 @@ func (c Config) Instance(ptr interface{}) error {
 }
 
 func (c Config) getValue(inst *instance, typ reflect.Type) reflect.Value {
+	if chosen := inst.selected(); chosen != nil {
+		inst = chosen
+	}
 	value := inst.Value()
 	ptyp := inst.val.Type()
 	pval := inst.val
@@ -248,13 +486,13 @@ func (c Config) Must(ptr interface{}) {
 // marshaled content. The configuration can thus be persisted and
 // restored with Schema.Unmarshal. If instances is true, then the
 // instance configuration is marshaled as well, so that they may be
-// restored.
+// restored. Secrets in provider and instance configurations are
+// encrypted if the configuration includes a KeySource; see Secret.
 func (c Config) Marshal(instances bool) ([]byte, error) {
-	keys := c.Keys.Clone()
-	keys["versions"] = c.versions
 	if instances {
 		// Make sure that reachable providers with instance configs are
-		// initialized.
+		// initialized. They are initialized before the lock is
+		// acquired, so that they may use the config.
 		for _, inst := range c.order {
 			if !inst.HasInstanceConfig() {
 				continue
@@ -263,30 +501,131 @@ func (c Config) Marshal(instances bool) ([]byte, error) {
 				return nil, err
 			}
 		}
-	} else {
+	}
+	defer c.lock()()
+	return c.marshal(instances)
+}
+
+// marshal marshals the config as in Marshal. If instances is true,
+// then instance configurations are marshaled as they are: instances
+// that have not been initialized are marshaled with the instance
+// configurations from which they were restored.
+func (c Config) marshal(instances bool) (p []byte, err error) {
+	if obs := c.getObserver(); obs != nil {
+		begin := time.Now()
+		defer func() {
+			obs.OnMarshal(Event{Duration: time.Since(begin), Err: err})
+		}()
+	}
+	keys := c.Keys.Clone()
+	keys["versions"] = c.versions
+	if !instances {
 		delete(keys, "instances")
 	}
+	if err := c.seal(keys); err != nil {
+		return nil, err
+	}
+	if err := restore(keys, c.refs); err != nil {
+		return nil, err
+	}
+	c.setMeta(keys)
 	return yaml.Marshal(keys)
 }
 
 // Setup performs any required provider setup actions implied by this
 // configuration. The configuration may be marshaled in the process
 // and the caller should (re-)marshal the configuration after setup
-// completes.
+// completes. SetupPersist and SetupAndSave persist the configuration
+// after each setup step instead.
 func (c Config) Setup() error {
+	return c.setup(nil)
+}
+
+// setup performs provider setup as in Setup, calling done (if
+// non-nil) after each instance's setup succeeds. The values required
+// by each instance's setup are initialized before the config's lock
+// is acquired for the setup itself; done is called with the lock
+// held.
+func (c Config) setup(done func(inst *instance) error) error {
 	for _, inst := range c.order {
-		impl := inst.Impl()
-		if version, ok := c.versions[impl]; ok && version >= inst.Version() {
+		if c.upToDate(inst) {
 			continue
 		}
-		if err := inst.Setup(); err != nil {
+		if err := inst.prepare((*instance).RequiresSetup); err != nil {
 			return fmt.Errorf("setup %s: %v", inst.Impl(), err)
 		}
-		c.versions[impl] = inst.Version()
+		if err := c.setupStep(inst, done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upToDate returns whether the instance's current version has been
+// set up.
+func (c Config) upToDate(inst *instance) bool {
+	defer c.rlock()()
+	version, ok := c.versions[inst.Impl()]
+	return ok && version >= inst.Version()
+}
+
+// setupStep sets up the instance while holding the config's lock,
+// unless it has since been set up concurrently, and then calls done
+// (if non-nil).
+func (c Config) setupStep(inst *instance, done func(inst *instance) error) error {
+	defer c.lock()()
+	impl := inst.Impl()
+	if version, ok := c.versions[impl]; ok && version >= inst.Version() {
+		return nil
+	}
+	if err := c.setupInstance(inst); err != nil {
+		return fmt.Errorf("setup %s: %v", impl, err)
+	}
+	c.setVersion(inst)
+	if done != nil {
+		return done(inst)
 	}
 	return nil
 }
 
+// setVersion records that the instance's current version has been
+// set up. Instances shared with a parent config (see With) record
+// their setup in the parent as well. setVersion must be called while
+// holding the config's lock.
+func (c Config) setVersion(inst *instance) {
+	c.versions[inst.Impl()] = inst.Version()
+	if versions := inst.config.versions; versions != nil {
+		versions[inst.Impl()] = inst.Version()
+	}
+}
+
+// clearVersion records that the instance has been torn down, as in
+// setVersion.
+func (c Config) clearVersion(inst *instance) {
+	delete(c.versions, inst.Impl())
+	delete(inst.config.versions, inst.Impl())
+}
+
+// lock acquires the config's exclusive lock, returning a function
+// that releases it.
+func (c Config) lock() (unlock func()) {
+	if c.mu == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	return c.mu.Unlock
+}
+
+// rlock acquires the config's shared lock, returning a function
+// that releases it.
+func (c Config) rlock() (unlock func()) {
+	if c.mu == nil {
+		return func() {}
+	}
+	c.mu.RLock()
+	return c.mu.RUnlock
+}
+
 func (c Config) provider(key string) (p *provider, name string, err error) {
 	args, ok, err := c.Keys.String(key)
 	if err != nil {
@@ -295,8 +634,8 @@ func (c Config) provider(key string) (p *provider, name string, err error) {
 	if !ok {
 		return nil, "", nil
 	}
-	argv := strings.SplitN(args, ",", 2)
-	return lookup(argv[0]), argv[0], nil
+	name = providerName(args)
+	return c.registry.find(name), name, nil
 }
 
 func (c Config) args(key string) []string {
@@ -307,9 +646,45 @@ func (c Config) args(key string) []string {
 	if !ok || args == "" {
 		return nil
 	}
+	args = strings.SplitN(args, "|", 2)[0]
 	return strings.Split(args, ",")[1:]
 }
 
+// providerName returns the name of the provider in the provided
+// provider string, i.e., the string up to its first flag or
+// decorator, or "firstof" for firstof combinators.
+func providerName(s string) string {
+	if strings.HasPrefix(s, firstOfName+"(") {
+		return firstOfName
+	}
+	if i := strings.IndexAny(s, ",|"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// setFlags sets the provided flags, given as "name=value" or
+// "name", in the instance's FlagSet.
+func setFlags(inst *instance, args []string) error {
+	flags := inst.Flags()
+	for _, arg := range args {
+		var (
+			kv  = strings.SplitN(arg, "=", 2)
+			err error
+		)
+		switch len(kv) {
+		case 1:
+			err = flags.Set(kv[0], "") // ok for booleans
+		case 2:
+			err = flags.Set(kv[0], kv[1])
+		}
+		if err != nil {
+			return fmt.Errorf("provider %s flag %s: %v", inst.Impl(), kv[0], err)
+		}
+	}
+	return nil
+}
+
 func assignUnique(src reflect.Type, dsts []reflect.Type) (reflect.Type, error) {
 	var matches []reflect.Type
 	for _, dst := range dsts {
@@ -363,87 +738,85 @@ func (c *Config) build() error {
 	if instanceConfigs == nil {
 		instanceConfigs = make(Keys)
 	}
+	outputs, _, err := c.Keys.Keys("outputs")
+	if err != nil {
+		return err
+	}
+	if outputs == nil {
+		outputs = make(Keys)
+	}
 	for typ, key := range c.types {
-		p, impl, err := c.provider(key)
-		if err != nil {
-			return err
-		}
-		if p == nil {
-			if impl != "" {
-				pkg := impl
-				pkg = strings.TrimRightFunc(pkg, func(r rune) bool { return r != '.' })
-				pkg = strings.TrimRight(pkg, ".")
-				return fmt.Errorf("%s: no provider named %s (is package %s linked into the binary?)", key, impl, pkg)
-			}
-			// Ignore missing providers. They only matter if they're
-			// going to be used when instantiating values later on.
-			continue
-		}
-		field, ok := assign(p.Type(), typ)
-		if !ok {
-			return fmt.Errorf("provider implements type %s, which is incompatible to the bound type %s", p.Type(), typ)
-		}
-		inst := p.New(*c, field)
-		flags := inst.Flags()
-		for _, arg := range c.args(key) {
-			var (
-				kv  = strings.SplitN(arg, "=", 2)
-				err error
-			)
-			switch len(kv) {
-			case 1:
-				err = flags.Set(kv[0], "") // ok for booleans
-			case 2:
-				err = flags.Set(kv[0], kv[1])
+		var inst *instance
+		if spec, _ := c.Keys[key].(string); strings.HasPrefix(spec, firstOfName+"(") {
+			if inst, err = c.firstOf(typ, key, spec); err != nil {
+				return err
 			}
+		} else {
+			p, impl, err := c.provider(key)
 			if err != nil {
-				return fmt.Errorf("provider %s flag %s: %v", impl, kv[0], err)
-			}
-		}
-		if src, dst := c.Value(impl), inst.Config(); src != nil && dst != nil {
-			if err := remarshal(src, dst); err != nil {
 				return err
 			}
-		}
-		if config := inst.Config(); config != nil {
-			c.Keys[impl] = config
-		}
-		// TODO(marius): support multiple instances per provider by naming
-		// these differently.
-		if src, dst := instanceConfigs.Value(impl), inst.InstanceConfig(); src != nil && dst != nil {
-			if err := remarshal(src, dst); err != nil {
+			if p == nil {
+				if impl != "" {
+					pkg := impl
+					pkg = strings.TrimRightFunc(pkg, func(r rune) bool { return r != '.' })
+					pkg = strings.TrimRight(pkg, ".")
+					return fmt.Errorf("%s: no provider named %s (is package %s linked into the binary, or is plugin %s%s on the plugin path?)", key, impl, pkg, PluginPrefix, impl)
+				}
+				// Ignore missing providers. They only matter if they're
+				// going to be used when instantiating values later on.
+				continue
+			}
+			field, ok := assign(p.Type(), typ)
+			if !ok {
+				return fmt.Errorf("provider implements type %s, which is incompatible to the bound type %s", p.Type(), typ)
+			}
+			inst = p.New(*c, field)
+			if err := setFlags(inst, c.args(key)); err != nil {
 				return err
 			}
 		}
-		if instanceConfig := inst.InstanceConfig(); instanceConfig != nil {
-			instanceConfigs[impl] = instanceConfig
+		if inst, err = c.decorate(inst, typ, key); err != nil {
+			return err
 		}
 		c.instances[typ] = inst
 	}
+	// The key source is configured first, so that it may be used
+	// to decrypt secrets in the configuration of other providers.
+	keySource := c.keySource()
+	if keySource != nil {
+		if len(keySource.RequiresInit()) > 0 {
+			return fmt.Errorf("key source %s may not depend on other providers", keySource.Impl())
+		}
+		if err := c.configure(keySource, instanceConfigs, outputs, false); err != nil {
+			return err
+		}
+	}
+	for _, inst := range c.allInstances() {
+		if inst == keySource {
+			continue
+		}
+		if err := c.configure(inst, instanceConfigs, outputs, true); err != nil {
+			return err
+		}
+	}
 	c.Keys["instances"] = instanceConfigs
+	if len(outputs) > 0 {
+		c.Keys["outputs"] = outputs
+	}
 
-	for _, src := range c.instances {
+	for _, src := range c.allInstances() {
+		// Candidates are initialized and set up through their
+		// firstof instances.
+		if src.candidate {
+			continue
+		}
 		graph.Add(src, nil)
-		for _, typ := range src.RequiresInit() {
-			typ, err = assignUnique(typ, c.typeset)
-			if err != nil {
-				return err
-			}
-			dst, ok := c.instances[typ]
-			if !ok {
-				log.Fatalf("%v Init requires %v: unspecified", src.name, typ)
-			}
-			graph.Add(src, dst)
+		dsts, err := c.requirements(src)
+		if err != nil {
+			return err
 		}
-		for _, typ := range src.RequiresSetup() {
-			typ, err = assignUnique(typ, c.typeset)
-			if err != nil {
-				return err
-			}
-			dst, ok := c.instances[typ]
-			if !ok {
-				log.Fatalf("%v Setup requires %v: unspecified", src.name, typ.Name())
-			}
+		for _, dst := range dsts {
 			graph.Add(src, dst)
 		}
 	}
@@ -458,6 +831,104 @@ func (c *Config) build() error {
 	return nil
 }
 
+// requirements returns the instances required by the instance src:
+// the instance it decorates, if any, those that provide values (or
+// outputs) required by its Init, Setup, Refresh, Import, or
+// Teardown methods, and, for firstof instances, those required by
+// its candidates.
+func (c *Config) requirements(src *instance) ([]*instance, error) {
+	var dsts []*instance
+	if src.inner != nil {
+		dsts = append(dsts, src.inner)
+	}
+	for _, cand := range src.candidates {
+		candDsts, err := c.requirements(cand)
+		if err != nil {
+			return nil, err
+		}
+		dsts = append(dsts, candDsts...)
+	}
+	for _, req := range []struct {
+		method string
+		types  []reflect.Type
+	}{
+		{"Init", src.RequiresInit()},
+		{"Setup", src.RequiresSetup()},
+		{"Refresh", src.RequiresRefresh()},
+		{"Import", src.RequiresImport()},
+		{"Teardown", src.RequiresTeardown()},
+	} {
+		for _, typ := range req.types {
+			if dst := c.outputs[typ]; dst != nil {
+				dsts = append(dsts, dst)
+				continue
+			}
+			typ, err := assignUnique(typ, c.typeset)
+			if err != nil {
+				return nil, err
+			}
+			dst, ok := c.instances[typ]
+			if !ok {
+				log.Fatalf("%v %s requires %v: unspecified", src.name, req.method, typ)
+			}
+			dsts = append(dsts, dst)
+		}
+	}
+	return dsts, nil
+}
+
+// configure restores the provider configuration, instance
+// configuration, and outputs of the instance inst from the config's
+// keys, instanceConfigs, and outputs respectively. If unseal is
+// true, then secrets in the restored configurations are decrypted.
+func (c *Config) configure(inst *instance, instanceConfigs, outputs Keys, unseal bool) error {
+	impl := inst.Impl()
+	if src, dst := c.Value(impl), inst.Config(); src != nil && dst != nil {
+		if unseal {
+			var err error
+			if src, err = c.unseal(src, dst); err != nil {
+				return fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+		if err := remarshal(src, dst); err != nil {
+			return err
+		}
+	}
+	if config := inst.Config(); config != nil {
+		c.Keys[impl] = config
+	}
+	// TODO(marius): support multiple instances per provider by naming
+	// these differently.
+	if src, dst := instanceConfigs.Value(impl), inst.InstanceConfig(); src != nil && dst != nil {
+		if unseal {
+			var err error
+			if src, err = c.unseal(src, dst); err != nil {
+				return fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+		if err := remarshal(src, dst); err != nil {
+			return err
+		}
+	}
+	if instanceConfig := inst.InstanceConfig(); instanceConfig != nil {
+		instanceConfigs[impl] = instanceConfig
+	}
+	if src, dst := outputs.Value(impl), inst.Outputs(); src != nil && dst != nil {
+		if err := remarshal(src, dst); err != nil {
+			return err
+		}
+	}
+	if output := inst.Outputs(); output != nil {
+		typ := reflect.TypeOf(output)
+		if other := c.outputs[typ]; other != nil && other != inst {
+			return fmt.Errorf("providers %s and %s both output type %s", other.Impl(), impl, typ)
+		}
+		c.outputs[typ] = inst
+		outputs[impl] = output
+	}
+	return nil
+}
+
 // Keys holds the toplevel configuration keys as managed
 // by a Keys. Each config instance defines a provider for this
 // type to be used by other providers that may need to access
@@ -477,6 +948,9 @@ func (k Keys) Keys(key string) (Keys, bool, error) {
 	if !ok {
 		return nil, false, nil
 	}
+	if keys, ok := v.(Keys); ok {
+		return keys.Clone(), true, nil
+	}
 	raw, ok := v.(map[interface{}]interface{})
 	if !ok {
 		return nil, false, fmt.Errorf("%v not proper key: %v", key, reflect.TypeOf(v))
@@ -552,6 +1026,12 @@ func deepcopy(v interface{}) interface{} {
 			copy[k] = deepcopy(v)
 		}
 		return copy
+	case map[string]int:
+		copy := make(map[string]int)
+		for k, v := range w {
+			copy[k] = v
+		}
+		return copy
 	default:
 		return v
 	}
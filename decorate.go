@@ -0,0 +1,160 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/grailbio/base/log"
+)
+
+// RegisterDecorator registers a decorator with the given name in
+// DefaultRegistry. See Registry.RegisterDecorator.
+func RegisterDecorator(name string, iface interface{}) {
+	DefaultRegistry.RegisterDecorator(name, iface)
+}
+
+// RegisterDecorator registers a decorator with the given name in the
+// registry r. A decorator wraps the value provided by another
+// provider, for example to add caching or rate limiting to it.
+// Decorators are selected in configurations by appending them,
+// along with their flags, to provider strings, separated by "|":
+//
+//	repository: s3blob|cached,size=1g|ratelimited,qps=100
+//
+// Here, the value provided by s3blob is decorated by cached, which
+// is in turn decorated by ratelimited.
+//
+// Decorators are registered like providers (see Register), and may
+// implement the same methods, except that a decorator must
+// implement Init, and that the first argument to its Init method is
+// the decorated value:
+//
+//	Init(inner type, req1 type1, req2 type2, ...) error
+//
+// The decorator's value must itself be assignable to the schema type
+// of the decorated key. Each layer of a decorated key is managed
+// separately: its configuration, instance configuration, and
+// version are stored under the name "decorator@key", e.g.,
+// "cached@repository", and it is set up after the value that it
+// decorates.
+func (r *Registry) RegisterDecorator(name string, iface interface{}) {
+	for _, c := range name {
+		if '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-' || c == '_' {
+			continue
+		}
+		log.Panicf("infra.RegisterDecorator: invalid name %s: identifiers may only contain 0-9, a-z, -, or _", name)
+	}
+	typ := reflect.TypeOf(iface)
+	p := &provider{name: name, typ: typ}
+	if err := p.Typecheck(); err != nil {
+		panic("infra.RegisterDecorator: invalid type " + p.typ.String() + " for decorator named " + name + ": " + err.Error())
+	}
+	if m, ok := typ.MethodByName("Init"); !ok || m.Type.NumIn() < 2 {
+		panic("infra.RegisterDecorator: decorator " + name + " must implement Init(inner type, ...) error")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.decorators[name] != nil {
+		panic("infra.RegisterDecorator: decorator named " + name + " is already registered")
+	}
+	if r.providers[name] != nil {
+		panic("infra.RegisterDecorator: " + name + " is already registered as a provider")
+	}
+	if _, ok := r.aliases[name]; ok {
+		panic("infra.RegisterDecorator: " + name + " is already registered as an alias")
+	}
+	r.decorators[name] = p
+}
+
+func (r *Registry) lookupDecorator(name string) *provider {
+	r.mu.Lock()
+	p := r.decorators[name]
+	r.mu.Unlock()
+	return p
+}
+
+// decorate returns the instance inst, bound to the provided schema
+// key and type, decorated by the decorators configured for the key.
+func (c *Config) decorate(inst *instance, typ reflect.Type, key string) (*instance, error) {
+	value, _ := c.Keys[key].(string)
+	layers := strings.Split(value, "|")[1:]
+	for _, layer := range layers {
+		argv := strings.Split(layer, ",")
+		p := c.registry.lookupDecorator(argv[0])
+		if p == nil {
+			return nil, fmt.Errorf("%s: no decorator named %s", key, argv[0])
+		}
+		field, ok := assign(p.Type(), typ)
+		if !ok {
+			return nil, fmt.Errorf("%s: decorator %s implements type %s, which is incompatible to the bound type %s", key, p.name, p.Type(), typ)
+		}
+		m, _ := p.Type().MethodByName("Init")
+		innerType := m.Type.In(1)
+		if !inst.provides(innerType, typ) {
+			return nil, fmt.Errorf("%s: decorator %s decorates type %s, which is incompatible to %s", key, p.name, innerType, inst.typ)
+		}
+		outer := p.New(*c, field)
+		outer.name = p.name + "@" + key
+		outer.inner = inst
+		if err := setFlags(outer, argv[1:]); err != nil {
+			return nil, err
+		}
+		inst = outer
+	}
+	return inst, nil
+}
+
+// innerValue initializes and returns the value decorated by the
+// instance, as required by its Init method.
+func (inst *instance) innerValue(ctx context.Context) (reflect.Value, error) {
+	if err := inst.inner.InitContext(ctx); err != nil {
+		return reflect.Value{}, err
+	}
+	m, _ := inst.typ.MethodByName("Init")
+	return inst.config.getValue(inst.inner, m.Type.In(1)), nil
+}
+
+// provides returns whether the instance, which is bound to the type
+// bound, provides values that are assignable to type typ.
+func (inst *instance) provides(typ, bound reflect.Type) bool {
+	if inst.candidates != nil {
+		for _, cand := range inst.candidates {
+			if !cand.provides(typ, bound) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := assign(inst.typ, typ)
+	return ok || inst.field != "" && bound.AssignableTo(typ)
+}
+
+// parts returns the instance along with the instances that it
+// comprises: the instances that it decorates, and its candidates.
+func (inst *instance) parts() []*instance {
+	parts := []*instance{inst}
+	if inst.inner != nil {
+		parts = append(parts, inst.inner.parts()...)
+	}
+	for _, cand := range inst.candidates {
+		parts = append(parts, cand.parts()...)
+	}
+	return parts
+}
+
+// allInstances returns all of the config's instances, including the
+// instances decorated by others and the candidates of firstof
+// instances.
+func (c Config) allInstances() []*instance {
+	var insts []*instance
+	for _, inst := range c.instances {
+		insts = append(insts, inst.parts()...)
+	}
+	return insts
+}
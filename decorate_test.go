@@ -0,0 +1,114 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type Store interface {
+	Get(key string) string
+}
+
+type testStore struct{}
+
+func (*testStore) Get(key string) string { return "value:" + key }
+
+type testCached struct {
+	Size  int  `yaml:"size"`
+	Ready bool `yaml:"ready"`
+
+	inner Store
+}
+
+func (c *testCached) Flags(flags *flag.FlagSet) {
+	flags.IntVar(&c.Size, "size", 0, "cache size")
+}
+
+func (c *testCached) Init(inner Store) error {
+	c.inner = inner
+	return nil
+}
+
+func (c *testCached) Setup() error {
+	c.Ready = true
+	return nil
+}
+
+func (c *testCached) Config() interface{} { return c }
+func (*testCached) Version() int          { return 1 }
+
+func (c *testCached) Get(key string) string { return "cached(" + c.inner.Get(key) + ")" }
+
+type testPrefixed struct {
+	prefix string
+	inner  Store
+}
+
+func (p *testPrefixed) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&p.prefix, "prefix", "", "key prefix")
+}
+
+func (p *testPrefixed) Init(inner Store) error {
+	p.inner = inner
+	return nil
+}
+
+func (p *testPrefixed) Get(key string) string { return p.prefix + p.inner.Get(key) }
+
+func init() {
+	infra.Register("teststore", new(testStore))
+	infra.RegisterDecorator("testcached", new(testCached))
+	infra.RegisterDecorator("testprefixed", new(testPrefixed))
+}
+
+func TestDecorator(t *testing.T) {
+	schema := infra.Schema{"store": new(Store)}
+	config, err := schema.Make(infra.Keys{
+		"store": "teststore|testcached,size=10|testprefixed,prefix=x:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store Store
+	config.Must(&store)
+	if got, want := store.Get("k"), "x:cached(value:k)"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"testcached@store:\n  size: 10\n  ready: true\n",
+		"  testcached@store: 1\n",
+		"  testprefixed@store: 0\n",
+		"  teststore: 0\n",
+	} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Must(&store)
+	if got, want := store.Get("k"), "x:cached(value:k)"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := schema.Make(infra.Keys{"store": "teststore|bogus"}); err == nil || !strings.Contains(err.Error(), "no decorator named bogus") {
+		t.Errorf("got %v, want decorator error", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// An InitError reports the initialization failures of one or more
+// instances, as encountered by Config.InitAll or by Make when
+// initializing eager instances.
+type InitError struct {
+	// Errs holds an error for each instance that failed to
+	// initialize, in dependency order. Instances that failed only
+	// because one of their dependencies failed are not included.
+	Errs []error
+}
+
+// Error implements error.
+func (e *InitError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// InitAll initializes every configured instance, in dependency
+// order. Whereas Instance initializes instances lazily, InitAll
+// allows a program to surface all initialization errors (e.g.,
+// missing credentials or unreachable services) at once, for
+// example during startup. Failures are reported together as an
+// *InitError. InitAll stops early if the provided context is
+// done, returning the context's error; retries of failed
+// initializations (see SetRetryPolicy) also stop when the context
+// is done.
+func (c Config) InitAll(ctx context.Context) error {
+	return c.initAll(ctx, nil)
+}
+
+// initAll initializes the instances in c for which the predicate
+// include returns true, or all instances if include is nil.
+func (c Config) initAll(ctx context.Context, include func(*instance) bool) error {
+	var (
+		errs   []error
+		failed = make(map[*instance]bool)
+	)
+	for _, inst := range c.order {
+		if include != nil && !include(inst) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := inst.InitContext(ctx)
+		if err == nil {
+			continue
+		}
+		failed[inst] = true
+		// Instances return the errors of their failed dependencies;
+		// these are reported only once.
+		if !c.dependsOn(inst, failed) {
+			errs = append(errs, fmt.Errorf("init %s: %v", inst.Impl(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return &InitError{errs}
+	}
+	return nil
+}
+
+// dependsOn returns whether the Init method of the instance inst
+// requires (or decorates) any of the provided instances.
+func (c Config) dependsOn(inst *instance, insts map[*instance]bool) bool {
+	if inst.inner != nil && insts[inst.inner] {
+		return true
+	}
+	for _, typ := range inst.RequiresInit() {
+		if c.outputs[typ] != nil {
+			// Outputs are provided without initialization.
+			continue
+		}
+		typ, err := assignUnique(typ, c.typeset)
+		if err == nil && insts[c.instances[typ]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type testConn struct {
+	fail, eager bool
+}
+
+func (c *testConn) Flags(flags *flag.FlagSet) {
+	flags.BoolVar(&c.fail, "fail", false, "fail initialization")
+	flags.BoolVar(&c.eager, "eager", false, "initialize eagerly")
+}
+
+func (c *testConn) Init() error {
+	if c.fail {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (c *testConn) Eager() bool { return c.eager }
+
+type testAuth struct {
+	fail bool
+}
+
+func (a *testAuth) Flags(flags *flag.FlagSet) {
+	flags.BoolVar(&a.fail, "fail", false, "fail initialization")
+}
+
+func (a *testAuth) Init() error {
+	if a.fail {
+		return errors.New("bad credentials")
+	}
+	return nil
+}
+
+type testConnUser struct{}
+
+func (*testConnUser) Init(conn *testConn) error { return nil }
+
+func init() {
+	infra.Register("testconn", new(testConn))
+	infra.Register("testauth", new(testAuth))
+	infra.Register("testconnuser", new(testConnUser))
+}
+
+var eagerSchema = infra.Schema{
+	"conn": new(testConn),
+	"auth": new(testAuth),
+	"user": new(testConnUser),
+}
+
+func TestInitAll(t *testing.T) {
+	config, err := eagerSchema.Make(infra.Keys{
+		"conn": "testconn,fail=true",
+		"auth": "testauth,fail=true",
+		"user": "testconnuser",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.InitAll(context.Background())
+	ierr, ok := err.(*infra.InitError)
+	if !ok {
+		t.Fatalf("got %v, want *infra.InitError", err)
+	}
+	// The failure of user is due to that of conn, and is not
+	// reported separately.
+	if got, want := len(ierr.Errs), 2; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, ierr)
+	}
+
+	config, err = eagerSchema.Make(infra.Keys{
+		"conn": "testconn",
+		"auth": "testauth",
+		"user": "testconnuser",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, want := config.InitAll(ctx), context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := config.InitAll(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEager(t *testing.T) {
+	keys := infra.Keys{
+		"conn": "testconn,fail=true",
+		"auth": "testauth",
+		"user": "testconnuser",
+	}
+	if _, err := eagerSchema.Make(keys); err != nil {
+		t.Fatal(err)
+	}
+	keys["conn"] = "testconn,fail=true,eager=true"
+	_, err := eagerSchema.Make(keys)
+	if got, want := err.Error(), "init testconn: connection refused"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUnmarshalLazy(t *testing.T) {
+	p := []byte("conn: testconn,fail=true,eager=true\nauth: testauth\nuser: testconnuser\n")
+	if _, err := eagerSchema.Unmarshal(p); err == nil {
+		t.Fatal("expected error")
+	}
+	config, err := eagerSchema.UnmarshalLazy(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn *testConn
+	if err := config.Instance(&conn); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -9,7 +9,14 @@ import (
 	"github.com/grailbio/infra"
 )
 
-func init() { infra.Register("ec2metadata", new(Session)) }
+func init() { RegisterProviders(infra.DefaultRegistry) }
+
+// RegisterProviders registers the providers defined by this package
+// in the registry reg. They are registered in infra.DefaultRegistry
+// when the package is initialized.
+func RegisterProviders(reg *infra.Registry) {
+	reg.Register("ec2metadata", new(Session))
+}
 
 // EC2Metadata is the infra provider for session.Session using AWS EC2 metadata
 type Session struct {
@@ -0,0 +1,87 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"reflect"
+	"strings"
+)
+
+// A configField describes a single struct field as it is marshaled
+// by YAML.
+type configField struct {
+	// Name is the YAML key of the field.
+	Name string
+	// Index is the field's index sequence, as used by
+	// reflect.Value.FieldByIndex.
+	Index []int
+	// Type is the field's type.
+	Type reflect.Type
+	// Tag is the field's struct tag.
+	Tag reflect.StructTag
+	// OmitEmpty tells whether the field is omitted when empty.
+	OmitEmpty bool
+}
+
+// configFields returns the fields of the struct type typ (or pointer
+// to struct) that are marshaled by YAML, following the rules of
+// package gopkg.in/yaml.v2: unexported fields and fields tagged "-"
+// are skipped, and fields tagged ",inline" are flattened into their
+// parent. Inlined maps are not returned. configFields returns nil if
+// typ is not a struct type.
+func configFields(typ reflect.Type) []configField {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []configField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "" && !strings.Contains(string(f.Tag), ":") {
+			tag = string(f.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		var (
+			opts      = strings.Split(tag, ",")
+			name      = opts[0]
+			inline    bool
+			omitEmpty bool
+		)
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "inline":
+				inline = true
+			case "omitempty":
+				omitEmpty = true
+			}
+		}
+		if inline {
+			for _, sub := range configFields(f.Type) {
+				sub.Index = append([]int{i}, sub.Index...)
+				fields = append(fields, sub)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields = append(fields, configField{
+			Name:      name,
+			Index:     []int{i},
+			Type:      f.Type,
+			Tag:       f.Tag,
+			OmitEmpty: omitEmpty,
+		})
+	}
+	return fields
+}
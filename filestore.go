@@ -0,0 +1,134 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a StateStore that stores a configuration in a local
+// file. The store's lock is implemented by a separate lock file,
+// named by the configuration file's path with the suffix ".lock".
+// On Unix systems, the lock is an flock(2) lock on the lock file,
+// which is released when the process exits. On other systems, the
+// lock is held by the lock file's existence; a lock file left behind
+// by a process that died while holding the lock must be removed
+// manually. Revisions are content hashes of the stored
+// configuration. Configurations are written atomically and durably
+// by syncing and renaming a temporary file.
+type FileStore struct {
+	// Path is the path of the file in which the configuration is
+	// stored.
+	Path string
+
+	mu   sync.Mutex
+	lock *os.File
+}
+
+// NewFileStore returns a new FileStore that stores its
+// configuration at the provided path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Load implements StateStore.
+func (f *FileStore) Load() ([]byte, string, error) {
+	p, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return p, revision(p), nil
+}
+
+// Save implements StateStore. If the store is not locked by the
+// caller, Save acquires the lock for the duration of the save.
+func (f *FileStore) Save(p []byte, rev string) (string, error) {
+	f.mu.Lock()
+	locked := f.lock != nil
+	f.mu.Unlock()
+	if !locked {
+		if err := f.Lock(); err != nil {
+			return "", err
+		}
+		defer f.Unlock()
+	}
+	_, current, err := f.Load()
+	if err != nil {
+		return "", err
+	}
+	if current != rev {
+		return "", ErrRevisionMismatch
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(p); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	// Make sure the contents are durable before they replace the
+	// stored configuration.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	// Make sure the rename itself is durable.
+	if err := syncDir(filepath.Dir(f.Path)); err != nil {
+		return "", err
+	}
+	return revision(p), nil
+}
+
+// Lock implements StateStore.
+func (f *FileStore) Lock() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock != nil {
+		return ErrLocked
+	}
+	lock, err := lockFile(f.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	f.lock = lock
+	return nil
+}
+
+// Unlock implements StateStore.
+func (f *FileStore) Unlock() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock == nil {
+		return errors.New("infra.FileStore: not locked")
+	}
+	err := unlockFile(f.lock)
+	f.lock = nil
+	return err
+}
+
+func revision(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,34 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package infra
+
+import "os"
+
+// lockFile acquires the lock by exclusively creating the lock file
+// at path, returning ErrLocked if it already exists.
+func lockFile(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	}
+	return lock, err
+}
+
+// unlockFile releases the lock acquired by lockFile by removing the
+// lock file.
+func unlockFile(lock *os.File) error {
+	err := lock.Close()
+	if rerr := os.Remove(lock.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// syncDir is a no-op: directories cannot be synced on all other
+// systems.
+func syncDir(path string) error { return nil }
@@ -0,0 +1,155 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/sync/once"
+)
+
+// firstOfName is the name of the firstof combinator. A key
+// configured as
+//
+//	session: firstof(ec2metadata,awssession)
+//
+// is bound to the first of the named providers whose Init method
+// succeeds, attempted in order. The chosen provider is recorded in
+// the instance configuration of the key's firstof instance, named
+// "firstof@key", so that a restored configuration binds the same
+// provider. Candidates are configured (and have their provider
+// configurations stored) as any other provider; setup is performed
+// only for the chosen candidate. Candidates may not have flags, but
+// the firstof combinator may be decorated (see RegisterDecorator).
+const firstOfName = "firstof"
+
+// firstOf is the value managed by firstof instances.
+type firstOf struct {
+	// Choice is the name of the chosen candidate.
+	Choice string `yaml:"choice,omitempty"`
+}
+
+// InstanceConfig records the choice of candidate.
+func (f *firstOf) InstanceConfig() interface{} { return f }
+
+var typeOfFirstOfPtr = reflect.TypeOf(new(firstOf))
+
+// firstOfNames returns the candidate names in the comma-separated
+// list list, ignoring surrounding whitespace.
+func firstOfNames(list string) []string {
+	names := strings.Split(list, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+// firstOf returns a new firstof instance for the provided key and
+// type, as configured by the provider string spec.
+func (c *Config) firstOf(typ reflect.Type, key, spec string) (*instance, error) {
+	spec = strings.SplitN(spec, "|", 2)[0]
+	if !strings.HasSuffix(spec, ")") {
+		return nil, fmt.Errorf("%s: malformed %s: %s", key, firstOfName, spec)
+	}
+	names := firstOfNames(spec[len(firstOfName)+1 : len(spec)-1])
+	inst := &instance{
+		typ:      typeOfFirstOfPtr,
+		val:      reflect.ValueOf(new(firstOf)),
+		name:     firstOfName + "@" + key,
+		config:   *c,
+		initOnce: new(once.Task),
+	}
+	for _, name := range names {
+		p := c.registry.find(name)
+		if p == nil {
+			return nil, fmt.Errorf("%s: no provider named %s", key, name)
+		}
+		field, ok := assign(p.Type(), typ)
+		if !ok {
+			return nil, fmt.Errorf("%s: provider %s implements type %s, which is incompatible to the bound type %s", key, name, p.Type(), typ)
+		}
+		cand := p.New(*c, field)
+		cand.candidate = true
+		inst.candidates = append(inst.candidates, cand)
+	}
+	return inst, nil
+}
+
+// choose binds the firstof instance to its recorded choice, if any,
+// or else to the first of its candidates that initializes
+// successfully.
+func (inst *instance) choose(ctx context.Context) error {
+	f := inst.val.Interface().(*firstOf)
+	if f.Choice != "" {
+		for _, cand := range inst.candidates {
+			if cand.Impl() != f.Choice {
+				continue
+			}
+			if err := cand.InitContext(ctx); err != nil {
+				return err
+			}
+			inst.choice(cand)
+			return nil
+		}
+		return fmt.Errorf("%s: recorded choice %s is not a candidate", firstOfName, f.Choice)
+	}
+	var errs []string
+	for _, cand := range inst.candidates {
+		if err := cand.InitContext(ctx); err != nil {
+			log.Debug.Printf("infra: %s: candidate %s failed: %v", inst.Impl(), cand.Impl(), err)
+			errs = append(errs, fmt.Sprintf("%s: %v", cand.Impl(), err))
+			continue
+		}
+		f.Choice = cand.Impl()
+		inst.choice(cand)
+		return nil
+	}
+	return fmt.Errorf("%s: all candidates failed: %s", firstOfName, strings.Join(errs, "; "))
+}
+
+// choice records the chosen candidate of the firstof instance.
+func (inst *instance) choice(cand *instance) {
+	inst.mu.Lock()
+	inst.chosen = cand
+	inst.mu.Unlock()
+}
+
+// selected returns the chosen candidate of the firstof instance, or
+// nil if the instance is not a firstof instance or has not yet
+// chosen a candidate.
+func (inst *instance) selected() *instance {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.chosen
+}
+
+// setupChosen performs setup of the firstof instance's chosen
+// candidate, choosing it first if needed.
+func (inst *instance) setupChosen() error {
+	if err := inst.Init(); err != nil {
+		return err
+	}
+	return inst.selected().Setup()
+}
+
+// candidateVersion returns the version of the firstof instance's
+// chosen candidate or, if none has been chosen yet, the largest
+// version of its candidates.
+func (inst *instance) candidateVersion() int {
+	if chosen := inst.selected(); chosen != nil {
+		return chosen.Version()
+	}
+	var version int
+	for _, cand := range inst.candidates {
+		if v := cand.Version(); v > version {
+			version = v
+		}
+	}
+	return version
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+// remoteStoreDown determines whether testremotestore fails to
+// initialize.
+var remoteStoreDown = true
+
+type testRemoteStore struct{}
+
+func (*testRemoteStore) Init() error {
+	if remoteStoreDown {
+		return errors.New("remote store is down")
+	}
+	return nil
+}
+
+func (*testRemoteStore) Get(key string) string { return "remote:" + key }
+
+func init() {
+	infra.Register("testremotestore", new(testRemoteStore))
+}
+
+func TestFirstOf(t *testing.T) {
+	defer func() { remoteStoreDown = true }()
+	schema := infra.Schema{"store": new(Store)}
+	config, err := schema.Make(infra.Keys{
+		"store": "firstof(testremotestore,teststore)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store Store
+	config.Must(&store)
+	if got, want := store.Get("k"), "value:k"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "firstof@store:\n    choice: teststore\n"; !strings.Contains(string(p), want) {
+		t.Errorf("marshaled config %s does not contain %q", p, want)
+	}
+
+	// The recorded choice is used even if an earlier candidate
+	// succeeds now.
+	remoteStoreDown = false
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Must(&store)
+	if got, want := store.Get("k"), "value:k"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	config, err = schema.Make(infra.Keys{"store": "firstof(testremotestore,teststore)|testprefixed,prefix=x:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Must(&store)
+	if got, want := store.Get("k"), "x:remote:k"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	remoteStoreDown = true
+	config, err = schema.Make(infra.Keys{"store": "firstof(testremotestore)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Instance(&store); err == nil || !strings.Contains(err.Error(), "all candidates failed: testremotestore: remote store is down") {
+		t.Errorf("got %v, want candidate error", err)
+	}
+	if _, err := schema.Make(infra.Keys{"store": "firstof(testcreds,teststore)"}); err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Errorf("got %v, want type error", err)
+	}
+}
+
+func TestFirstOfSpaces(t *testing.T) {
+	schema := infra.Schema{"store": new(Store)}
+	config, err := schema.Make(infra.Keys{"store": "firstof( testremotestore, teststore )"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store Store
+	config.Must(&store)
+	if got, want := store.Get("k"), "value:k"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "firstof@store:\n    choice: teststore\n"; !strings.Contains(string(p), want) {
+		t.Errorf("marshaled config %s does not contain %q", p, want)
+	}
+}
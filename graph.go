@@ -0,0 +1,58 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteGraph writes the configuration's dependency graph to w in the
+// Graphviz DOT format. Nodes are the configured instances, labeled
+// by their schema keys and providers; an edge from one instance to
+// another denotes that the former requires the latter.
+func (c Config) WriteGraph(w io.Writer) error {
+	defer c.rlock()()
+	var (
+		nodes []string
+		edges = make(map[string][]string)
+	)
+	for _, inst := range c.order {
+		node := fmt.Sprintf("%s (%s)", c.key(inst), inst.Impl())
+		nodes = append(nodes, node)
+		dsts, err := c.requirements(inst)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, dst := range dsts {
+			if dst.candidate {
+				continue
+			}
+			edge := fmt.Sprintf("%s (%s)", c.key(dst), dst.Impl())
+			if edge == node || seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			edges[node] = append(edges[node], edge)
+		}
+	}
+	sort.Strings(nodes)
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph infra {")
+	for _, node := range nodes {
+		fmt.Fprintf(b, "\t%q;\n", node)
+	}
+	for _, node := range nodes {
+		sort.Strings(edges[node])
+		for _, edge := range edges[node] {
+			fmt.Fprintf(b, "\t%q -> %q;\n", node, edge)
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestWriteGraph(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := config.WriteGraph(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), `digraph infra {
+	"cluster (testcluster)";
+	"creds (testcreds)";
+	"setup (testsetup)";
+	"cluster (testcluster)" -> "creds (testcreds)";
+}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteHelp renders the provided usages, as returned by Config.Help,
+// as plain text to w. Schema keys are rendered in sorted order.
+// WriteHelp is suitable for command line --help output.
+func WriteHelp(w io.Writer, help map[string][]Usage) error {
+	b := bufio.NewWriter(w)
+	for i, key := range helpKeys(help) {
+		if i > 0 {
+			fmt.Fprintln(b)
+		}
+		fmt.Fprintf(b, "%s:\n", key)
+		for _, u := range help[key] {
+			fmt.Fprintf(b, "  %s (version %d)\n", u.Name, u.Version)
+			if u.Usage != "" {
+				fmt.Fprintf(b, "    %s\n", u.Usage)
+			}
+			for _, arg := range u.Args {
+				fmt.Fprintf(b, "    -%s", arg.Name)
+				if arg.DefaultValue != "" {
+					fmt.Fprintf(b, " (default %q)", arg.DefaultValue)
+				}
+				fmt.Fprintf(b, "\n        %s\n", arg.Help)
+			}
+			if len(u.Config) > 0 {
+				fmt.Fprintf(b, "    config:\n")
+				for _, f := range u.Config {
+					if f.Name == "" {
+						fmt.Fprintf(b, "      %s\n", f.Type)
+					} else {
+						fmt.Fprintf(b, "      %s %s\n", f.Name, f.Type)
+					}
+				}
+			}
+			if len(u.Init) > 0 {
+				fmt.Fprintf(b, "    init requires: %s\n", formatDependencies(u.Init))
+			}
+			if len(u.Setup) > 0 {
+				fmt.Fprintf(b, "    setup requires: %s\n", formatDependencies(u.Setup))
+			}
+			if u.InstanceConfig {
+				fmt.Fprintf(b, "    instances may be marshaled\n")
+			}
+		}
+	}
+	return b.Flush()
+}
+
+// WriteHelpMarkdown renders the provided usages, as returned by
+// Config.Help, as Markdown to w. Schema keys are rendered in sorted
+// order.
+func WriteHelpMarkdown(w io.Writer, help map[string][]Usage) error {
+	b := bufio.NewWriter(w)
+	for i, key := range helpKeys(help) {
+		if i > 0 {
+			fmt.Fprintln(b)
+		}
+		fmt.Fprintf(b, "## %s\n", key)
+		for _, u := range help[key] {
+			fmt.Fprintf(b, "\n### %s\n\n", u.Name)
+			if u.Usage != "" {
+				fmt.Fprintf(b, "%s\n\n", u.Usage)
+			}
+			fmt.Fprintf(b, "- Version: %d\n", u.Version)
+			fmt.Fprintf(b, "- Instance marshaling: %t\n", u.InstanceConfig)
+			if len(u.Init) > 0 {
+				fmt.Fprintf(b, "- Init requires: %s\n", formatDependencies(u.Init))
+			}
+			if len(u.Setup) > 0 {
+				fmt.Fprintf(b, "- Setup requires: %s\n", formatDependencies(u.Setup))
+			}
+			if len(u.Args) > 0 {
+				fmt.Fprintf(b, "\n| Flag | Default | Description |\n|---|---|---|\n")
+				for _, arg := range u.Args {
+					fmt.Fprintf(b, "| `%s` | %s | %s |\n", arg.Name, markdownCode(arg.DefaultValue), markdownEscape(arg.Help))
+				}
+			}
+			if len(u.Config) > 0 {
+				fmt.Fprintf(b, "\n| Config field | Type |\n|---|---|\n")
+				for _, f := range u.Config {
+					fmt.Fprintf(b, "| %s | `%s` |\n", markdownCode(f.Name), f.Type)
+				}
+			}
+		}
+	}
+	return b.Flush()
+}
+
+func helpKeys(help map[string][]Usage) []string {
+	keys := make([]string, 0, len(help))
+	for key := range help {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatDependencies(deps []Dependency) string {
+	strs := make([]string, len(deps))
+	for i, dep := range deps {
+		if dep.Key == "" {
+			strs[i] = dep.Type + " (unbound)"
+		} else {
+			strs[i] = dep.Type + " (" + dep.Key + ")"
+		}
+	}
+	return strings.Join(strs, ", ")
+}
+
+func markdownEscape(s string) string {
+	return strings.Replace(s, "|", `\|`, -1)
+}
+
+// markdownCode returns s as a Markdown code span, or the empty
+// string if s is empty.
+func markdownCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + s + "`"
+}
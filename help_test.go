@@ -0,0 +1,81 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestHelp(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	help := config.Help()
+	if got, want := len(help["cluster"]), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	u := help["cluster"][0]
+	deps := []infra.Dependency{{Type: "*infra_test.testCreds", Key: "creds"}}
+	if got, want := u, (infra.Usage{
+		Name: "testcluster",
+		Config: []infra.Field{
+			{"instance_type", "string"},
+			{"num_instances", "int"},
+			{"setup_user", "string"},
+		},
+		Init:           deps,
+		Setup:          deps,
+		Version:        1,
+		InstanceConfig: true,
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	u = help["creds"][0]
+	if got, want := u.Config, []infra.Field{{Type: "infra_test.testCreds"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := u.Args, []infra.Flag{{Name: "user", Help: "the user name"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var b bytes.Buffer
+	if err := infra.WriteHelp(&b, help); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"cluster:\n  testcluster (version 1)\n",
+		"      num_instances int\n",
+		"    init requires: *infra_test.testCreds (creds)\n",
+		"    -user\n        the user name\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("help text %q does not contain %q", b.String(), want)
+		}
+	}
+	b.Reset()
+	if err := infra.WriteHelpMarkdown(&b, help); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"## cluster\n\n### testcluster\n",
+		"| `num_instances` | `int` |\n",
+		"- Setup requires: *infra_test.testCreds (creds)\n",
+		"| `user` |  | the user name |\n",
+		"| Config field | Type |\n|---|---|\n|  | `infra_test.testCreds` |\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("markdown %q does not contain %q", b.String(), want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import "fmt"
+
+// Import adopts the existing infrastructure resource identified by
+// id into the configuration, using the provider configured for the
+// schema key key. The provider's Import method populates its
+// configuration and instance configuration from the live resource;
+// the provider's version is then marked as current, so that a
+// subsequent Setup does not attempt to recreate the resource. The
+// caller should (re-)marshal the configuration after Import
+// completes.
+func (c Config) Import(key, id string) error {
+	inst := c.instanceFor(key)
+	if inst == nil {
+		return fmt.Errorf("import %s: no provider configured for key %s", id, key)
+	}
+	if inst.HasImport() {
+		if err := inst.prepare((*instance).RequiresImport); err != nil {
+			return fmt.Errorf("import %s: %s: %v", id, inst.Impl(), err)
+		}
+	}
+	defer c.lock()()
+	if err := inst.Import(id); err != nil {
+		return fmt.Errorf("import %s: %s: %v", id, inst.Impl(), err)
+	}
+	c.setVersion(inst)
+	return nil
+}
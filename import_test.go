@@ -0,0 +1,63 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func (b *testBucket) Import(name string, creds *testCreds) error {
+	region, ok := testBuckets[name]
+	if !ok {
+		return errors.New("no such bucket")
+	}
+	b.Name, b.Region = name, region
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	testBuckets["existing"] = "eu-west-1"
+	schema := infra.Schema{
+		"creds":  new(testCreds),
+		"bucket": new(testBucket),
+	}
+	config, err := schema.Make(infra.Keys{
+		"creds":  "testcreds",
+		"bucket": "testbucket",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Import("bucket", "nonexistent"); err == nil || err.Error() != "import nonexistent: testbucket: no such bucket" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := config.Import("creds", "xyz"); err == nil || !strings.Contains(err.Error(), "does not support import") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := config.Import("bucket", "existing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	var bucket *testBucket
+	config.Must(&bucket)
+	if got, want := bucket.setups, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"testbucket:\n  name: existing\n  region: eu-west-1\n", "versions:\n  testbucket: 0\n"} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+}
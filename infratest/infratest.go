@@ -0,0 +1,198 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package infratest provides utilities for testing infrastructure
+// providers: building configurations from inline providers, and
+// asserting that providers are well-behaved with respect to setup
+// and marshaling.
+package infratest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/infra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var update = flag.Bool("infratest.update", false, "update golden files")
+
+// Registry is the registry in which inline providers are
+// registered. It is isolated from infra.DefaultRegistry, so that
+// test providers do not collide with other providers. Tests may
+// register additional providers in Registry.
+var Registry = infra.NewRegistry()
+
+var (
+	mu    sync.Mutex
+	names = make(map[reflect.Type]string)
+)
+
+// name returns the provider name under which the provided value's
+// type is registered in Registry, registering it if needed.
+// Providers are registered under their lowercased type names,
+// prefixed by "infratest-" so that they do not collide with schema
+// keys, and suffixed by a number if the name is already taken.
+func name(value interface{}) string {
+	typ := reflect.TypeOf(value)
+	mu.Lock()
+	defer mu.Unlock()
+	if name, ok := names[typ]; ok {
+		return name
+	}
+	base := typ
+	for base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+	name := "infratest-" + strings.ToLower(base.Name())
+	for i := 2; ; i++ {
+		if _, ok := Registry.Lookup(name); !ok {
+			break
+		}
+		name = fmt.Sprintf("infratest-%s%d", strings.ToLower(base.Name()), i)
+	}
+	Registry.Register(name, value)
+	names[typ] = name
+	return name
+}
+
+// A Flagged value is a provider with flags, as returned by Flags.
+type Flagged struct {
+	Value interface{}
+	Args  []string
+}
+
+// Flags returns the provider value with the provided flags, given
+// as "name=value" or "name" (for boolean flags).
+func Flags(value interface{}, args ...string) Flagged {
+	return Flagged{value, args}
+}
+
+// Providers maps schema keys to the providers that implement them.
+// Provider values are either zero values (as passed to
+// infra.Register) or Flagged values.
+type Providers map[string]interface{}
+
+// Schema returns a schema and configuration keys that bind each key
+// in providers to its provider. The schema's types are the
+// providers' own types.
+func (p Providers) Schema() (infra.Schema, infra.Keys) {
+	var (
+		schema = make(infra.Schema)
+		keys   = make(infra.Keys)
+	)
+	for key, value := range p {
+		var args []string
+		if flagged, ok := value.(Flagged); ok {
+			value, args = flagged.Value, flagged.Args
+		}
+		schema[key] = value
+		keys[key] = strings.Join(append([]string{name(value)}, args...), ",")
+	}
+	return schema, keys
+}
+
+// Make returns a configuration built from the provided inline
+// providers, as in Providers.Schema, using Registry. Make fails the
+// test if the configuration cannot be made.
+func Make(t testing.TB, providers Providers) (infra.Schema, infra.Config) {
+	t.Helper()
+	schema, keys := providers.Schema()
+	config, err := schema.MakeWithRegistry(Registry, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema, config
+}
+
+// RoundTrip asserts that the provided configuration, which must be
+// made from the provided schema and Registry, survives a round-trip through
+// Marshal and Unmarshal: the provider configurations and instance
+// configurations of the restored configuration must marshal
+// identically.
+func RoundTrip(t testing.TB, schema infra.Schema, config infra.Config) {
+	t.Helper()
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := schema.UnmarshalWithRegistry(Registry, p)
+	if err != nil {
+		t.Fatalf("unmarshal %s: %v", p, err)
+	}
+	q, err := restored.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, q) {
+		t.Errorf("configuration did not round-trip:\noriginal:\n%s\nrestored:\n%s", p, q)
+	}
+}
+
+// SetupIdempotent asserts that setting up the provided
+// configuration, which must be made from the provided schema and
+// Registry, is idempotent: after performing setup, performing setup
+// again from the marshaled configuration (with provider versions
+// cleared, so that setup is not skipped) must yield an identical
+// configuration.
+func SetupIdempotent(t testing.TB, schema infra.Schema, config infra.Config) {
+	t.Helper()
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(infra.Keys)
+	if err := yaml.Unmarshal(p, keys); err != nil {
+		t.Fatal(err)
+	}
+	delete(keys, "versions")
+	again, err := schema.MakeWithRegistry(Registry, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Setup(); err != nil {
+		t.Fatalf("second setup: %v", err)
+	}
+	q, err := again.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, q) {
+		t.Errorf("setup is not idempotent:\nfirst setup:\n%s\nsecond setup:\n%s", p, q)
+	}
+}
+
+// Golden asserts that the marshaled configuration (without instance
+// configurations) matches the contents of the golden file at path.
+// If the flag -infratest.update is set, then the golden file is
+// updated instead.
+func Golden(t testing.TB, config infra.Config, path string) {
+	t.Helper()
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile(path, p, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, want) {
+		t.Errorf("marshaled configuration does not match golden file %s:\ngot:\n%s\nwant:\n%s", path, p, want)
+	}
+}
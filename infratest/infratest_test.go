@@ -0,0 +1,71 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infratest_test
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/grailbio/infra/infratest"
+)
+
+type user string
+
+func (u *user) Flags(flags *flag.FlagSet) {
+	flags.StringVar((*string)(u), "name", "", "the user name")
+}
+
+func (u *user) Config() interface{} { return u }
+
+type bucket struct {
+	Name  string `yaml:"name"`
+	Owner string `yaml:"owner"`
+
+	instance struct {
+		ARN string `yaml:"arn"`
+	}
+}
+
+func (b *bucket) Init(u *user) error {
+	b.instance.ARN = "arn:" + b.Name
+	return nil
+}
+
+func (b *bucket) Setup(u *user) error {
+	b.Name = "bucket-" + string(*u)
+	b.Owner = string(*u)
+	return nil
+}
+
+func (b *bucket) Config() interface{}         { return b }
+func (b *bucket) InstanceConfig() interface{} { return &b.instance }
+func (*bucket) Version() int                  { return 1 }
+
+var providers = infratest.Providers{
+	"user":   infratest.Flags(new(user), "name=xyz"),
+	"bucket": new(bucket),
+}
+
+func TestRoundTrip(t *testing.T) {
+	schema, config := infratest.Make(t, providers)
+	var b *bucket
+	if err := config.Instance(&b); err != nil {
+		t.Fatal(err)
+	}
+	infratest.RoundTrip(t, schema, config)
+}
+
+func TestSetupIdempotent(t *testing.T) {
+	schema, config := infratest.Make(t, providers)
+	infratest.SetupIdempotent(t, schema, config)
+}
+
+func TestGolden(t *testing.T) {
+	_, config := infratest.Make(t, providers)
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	infratest.Golden(t, config, "testdata/config.golden")
+}
@@ -0,0 +1,337 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A Prompt asks for the value of a provider flag or configuration
+// field in Schema.Interactive. Providers declare prompts with their
+// Prompts method (see Register).
+type Prompt struct {
+	// Flag is the name of the flag whose value is asked for.
+	Flag string
+	// Field is the dot-separated YAML path of the field in the
+	// provider's configuration whose value is asked for. Exactly one
+	// of Flag and Field should be set.
+	Field string
+	// Text is the question asked. If empty, the flag's usage or the
+	// field's path is used.
+	Text string
+	// Default is the value used if the answer is empty. If empty, the
+	// flag's default value or the field's current value is used.
+	Default string
+	// Validate, if non-nil, validates answers. Invalid answers are
+	// asked for again.
+	Validate func(answer string) error
+}
+
+// Interactive asks for a configuration of the schema s, as in
+// InteractiveWithRegistry, with the providers registered in
+// DefaultRegistry.
+func (s Schema) Interactive(r io.Reader, w io.Writer) ([]byte, error) {
+	return s.InteractiveWithRegistry(DefaultRegistry, r, w)
+}
+
+// InteractiveWithRegistry asks for a configuration of the schema s
+// by writing prompts to w and reading answers, one per line, from r.
+// For each schema key, in order, it lists the providers registered in
+// reg that are compatible with the key's type and asks for one of
+// them, by number or name. It then asks for the chosen provider's
+// parameters, as declared by its Prompts method, or else for each of
+// its flags. Empty answers select defaults, as do missing answers at
+// the end of r. Invalid answers are asked for again.
+// InteractiveWithRegistry returns an error, before asking anything,
+// if any key has no compatible providers in reg.
+//
+// The resulting configuration is validated as by Make, without
+// initializing any instances, and returned marshaled as by
+// Config.Marshal(false), ready to be used with Unmarshal.
+func (s Schema) InteractiveWithRegistry(reg *Registry, r io.Reader, w io.Writer) ([]byte, error) {
+	if err := s.checkReserved(); err != nil {
+		return nil, err
+	}
+	in := &interview{r: bufio.NewReader(r), w: w}
+	types := s.types()
+	names := make([]string, 0, len(types))
+	typeOf := make(map[string]reflect.Type, len(types))
+	for typ, key := range types {
+		names = append(names, key)
+		typeOf[key] = typ
+	}
+	sort.Strings(names)
+	// Find the candidate providers of all keys before asking
+	// anything, so that a key that cannot be configured is reported
+	// before any answers are given.
+	var (
+		candidatesOf = make(map[string][]*provider, len(names))
+		fieldsOf     = make(map[string][]string, len(names))
+		missing      []string
+	)
+	for _, key := range names {
+		typ := typeOf[key]
+		for _, p := range reg.registered() {
+			if field, ok := assign(p.Type(), typ); ok {
+				candidatesOf[key] = append(candidatesOf[key], p)
+				fieldsOf[key] = append(fieldsOf[key], field)
+			}
+		}
+		if len(candidatesOf[key]) == 0 {
+			missing = append(missing, fmt.Sprintf("%s (type %s)", key, typ))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no providers for keys: %s", strings.Join(missing, ", "))
+	}
+	keys := make(Keys)
+	for _, key := range names {
+		var (
+			typ        = typeOf[key]
+			candidates = candidatesOf[key]
+			fields     = fieldsOf[key]
+		)
+		fmt.Fprintf(w, "%s: providers for type %s:\n", key, typ)
+		for i, p := range candidates {
+			help := p.New(Config{}, fields[i]).Help()
+			if j := strings.Index(help, "\n"); j >= 0 {
+				help = help[:j]
+			}
+			if help == "" {
+				fmt.Fprintf(w, "  %d) %s\n", i+1, p.name)
+			} else {
+				fmt.Fprintf(w, "  %d) %s: %s\n", i+1, p.name, help)
+			}
+		}
+		choice := -1
+		for choice < 0 {
+			answer, err := in.ask(key+" provider", candidates[0].name)
+			if err != nil {
+				return nil, err
+			}
+			for i, p := range candidates {
+				if answer == p.name || answer == strconv.Itoa(i+1) {
+					choice = i
+				}
+			}
+			if choice < 0 {
+				if err := in.invalid(fmt.Errorf("no provider %s for key %s", answer, key)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p := candidates[choice]
+		provider, config, err := in.configure(p.New(Config{}, fields[choice]))
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = provider
+		if len(config) > 0 {
+			keys[p.name] = config
+		}
+	}
+	config, err := s.make(reg, keys)
+	if err != nil {
+		return nil, err
+	}
+	return config.Marshal(false)
+}
+
+// An interview reads answers to prompts.
+type interview struct {
+	r   *bufio.Reader
+	w   io.Writer
+	eof bool
+}
+
+// ask asks the provided question, returning the answer, or def if
+// the answer is empty.
+func (in *interview) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(in.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(in.w, "%s: ", question)
+	}
+	var line string
+	if !in.eof {
+		var err error
+		line, err = in.r.ReadString('\n')
+		if err == io.EOF {
+			in.eof = true
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if in.eof {
+		fmt.Fprintln(in.w)
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// invalid reports an invalid answer. It returns an error if no more
+// answers can be read.
+func (in *interview) invalid(err error) error {
+	fmt.Fprintf(in.w, "invalid answer: %v\n", err)
+	if in.eof {
+		return fmt.Errorf("%v (at end of input)", err)
+	}
+	return nil
+}
+
+// configure asks for the parameters of the provided instance,
+// returning its provider string and configuration.
+func (in *interview) configure(inst *instance) (string, Keys, error) {
+	var (
+		prompts = inst.Prompts()
+		flags   = inst.Flags()
+		args    = []string{inst.Impl()}
+		config  = make(Keys)
+	)
+	if prompts == nil {
+		flags.VisitAll(func(f *flag.Flag) {
+			prompts = append(prompts, Prompt{Flag: f.Name})
+		})
+	}
+	for _, prompt := range prompts {
+		switch {
+		case prompt.Flag != "":
+			f := flags.Lookup(prompt.Flag)
+			if f == nil {
+				return "", nil, fmt.Errorf("provider %s: prompt for undefined flag %s", inst.Impl(), prompt.Flag)
+			}
+			text, def := prompt.Text, prompt.Default
+			if text == "" {
+				text = fmt.Sprintf("%s (%s)", f.Name, f.Usage)
+			}
+			if def == "" {
+				def = f.DefValue
+			}
+			answer, err := in.answer(text, def, prompt.Validate, func(answer string) error {
+				if strings.ContainsAny(answer, ",|") {
+					return errors.New("flag values may not contain , or |")
+				}
+				return flags.Set(f.Name, answer)
+			})
+			if err != nil {
+				return "", nil, fmt.Errorf("provider %s flag %s: %v", inst.Impl(), f.Name, err)
+			}
+			if answer != f.DefValue {
+				args = append(args, f.Name+"="+answer)
+			}
+		case prompt.Field != "":
+			dst := inst.Config()
+			if dst == nil {
+				return "", nil, fmt.Errorf("provider %s: prompt for field %s, but the provider has no configuration", inst.Impl(), prompt.Field)
+			}
+			path := strings.Split(prompt.Field, ".")
+			text, def := prompt.Text, prompt.Default
+			if text == "" {
+				text = prompt.Field
+			}
+			if def == "" {
+				def = fieldValue(dst, path)
+			}
+			_, err := in.answer(text, def, prompt.Validate, func(answer string) error {
+				setField(config, path, parseScalar(answer))
+				return remarshal(config, inst.Config())
+			})
+			if err != nil {
+				return "", nil, fmt.Errorf("provider %s field %s: %v", inst.Impl(), prompt.Field, err)
+			}
+		default:
+			return "", nil, fmt.Errorf("provider %s: prompt %q sets neither a flag nor a field", inst.Impl(), prompt.Text)
+		}
+	}
+	return strings.Join(args, ","), config, nil
+}
+
+// answer asks the provided question until the answer passes both
+// validate (if non-nil) and set.
+func (in *interview) answer(text, def string, validate, set func(string) error) (string, error) {
+	for {
+		answer, err := in.ask(text, def)
+		if err != nil {
+			return "", err
+		}
+		if validate != nil {
+			err = validate(answer)
+		}
+		if err == nil {
+			err = set(answer)
+		}
+		if err == nil {
+			return answer, nil
+		}
+		if err := in.invalid(err); err != nil {
+			return "", err
+		}
+	}
+}
+
+// fieldValue returns the value at the provided path in the YAML
+// encoding of the configuration v, or an empty string if there is
+// none or if it is not a scalar.
+func fieldValue(v interface{}, path []string) string {
+	p, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(p, &tree); err != nil {
+		return ""
+	}
+	for _, elem := range path {
+		m, ok := tree.(map[interface{}]interface{})
+		if !ok {
+			return ""
+		}
+		tree = m[elem]
+	}
+	switch tree.(type) {
+	case nil, map[interface{}]interface{}, []interface{}:
+		return ""
+	}
+	return fmt.Sprint(tree)
+}
+
+// setField sets the value at the provided path in keys.
+func setField(keys Keys, path []string, v interface{}) {
+	for _, elem := range path[:len(path)-1] {
+		next, ok := keys[elem].(Keys)
+		if !ok {
+			next = make(Keys)
+			keys[elem] = next
+		}
+		keys = next
+	}
+	keys[path[len(path)-1]] = v
+}
+
+// parseScalar returns the YAML scalar value of the answer s, so that
+// numbers and booleans retain their types, or else s itself.
+func parseScalar(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case nil, map[interface{}]interface{}, []interface{}:
+		return s
+	}
+	return v
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type Database interface {
+	Addr() string
+}
+
+type testDatabase struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+
+	name string
+}
+
+func (d *testDatabase) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&d.name, "name", "main", "database name")
+}
+
+func (d *testDatabase) Config() interface{} { return d }
+
+func (*testDatabase) Help() string { return "a test database\nwith a longer description" }
+
+func (d *testDatabase) Prompts() []infra.Prompt {
+	return []infra.Prompt{
+		{Flag: "name", Text: "database name"},
+		{Field: "host", Default: "localhost"},
+		{Field: "port", Text: "database port", Default: "5432", Validate: func(answer string) error {
+			if port, err := strconv.Atoi(answer); err != nil || port <= 0 {
+				return errors.New("port must be a positive integer")
+			}
+			return nil
+		}},
+	}
+}
+
+func (d *testDatabase) Addr() string {
+	return d.Host + ":" + strconv.Itoa(d.Port) + "/" + d.name
+}
+
+type testMemDatabase struct{}
+
+func (*testMemDatabase) Addr() string { return "mem" }
+
+type testQueueFlags struct {
+	size int
+}
+
+func (q *testQueueFlags) Flags(flags *flag.FlagSet) {
+	flags.IntVar(&q.size, "size", 10, "queue size")
+}
+
+func TestInteractive(t *testing.T) {
+	reg := infra.NewRegistry()
+	reg.Register("testdb", new(testDatabase))
+	reg.Register("testmemdb", new(testMemDatabase))
+	reg.Register("testqueueflags", new(testQueueFlags))
+	schema := infra.Schema{
+		"db":    new(Database),
+		"queue": new(testQueueFlags),
+	}
+	input := strings.Join([]string{
+		"bogus",    // db provider: invalid
+		"1",        // db provider: testdb
+		"",         // name: default
+		"db.local", // host
+		"-1",       // port: invalid
+		"6543",     // port
+		"",         // queue provider: testqueueflags
+		"x,y",      // queue size: invalid
+		"20",       // queue size
+	}, "\n")
+	var out bytes.Buffer
+	p, err := schema.InteractiveWithRegistry(reg, strings.NewReader(input), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"db: providers for type infra_test.Database:\n  1) testdb: a test database\n  2) testmemdb\n",
+		"db provider [testdb]: invalid answer: no provider bogus for key db\n",
+		"database name [main]: host [localhost]: database port [5432]: invalid answer: port must be a positive integer\n",
+		"size (queue size) [10]: invalid answer: flag values may not contain , or |\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+	if got, want := string(p), `db: testdb
+queue: testqueueflags,size=20
+testdb:
+  host: db.local
+  port: 6543
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	config, err := schema.UnmarshalWithRegistry(reg, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db Database
+	config.Must(&db)
+	if got, want := db.Addr(), "db.local:6543/main"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Defaults are used at the end of input, but invalid defaults
+	// are errors.
+	p, err = schema.InteractiveWithRegistry(reg, strings.NewReader("testmemdb\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), "db: testmemdb\nqueue: testqueueflags\nversions: {}\n"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = schema.InteractiveWithRegistry(reg, strings.NewReader("1\n\n\n0"), &out)
+	if err == nil || !strings.Contains(err.Error(), "port must be a positive integer (at end of input)") {
+		t.Errorf("got %v, want validation error", err)
+	}
+}
+
+func TestInteractiveNoProviders(t *testing.T) {
+	reg := infra.NewRegistry()
+	reg.Register("testdb", new(testDatabase))
+	schema := infra.Schema{
+		"db":    new(Database),
+		"creds": new(testCreds),
+	}
+	var out bytes.Buffer
+	_, err := schema.InteractiveWithRegistry(reg, strings.NewReader("testdb\n"), &out)
+	if err == nil || !strings.Contains(err.Error(), "no providers for keys: creds (type *infra_test.testCreds)") {
+		t.Errorf("got %v, want missing providers error", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected prompts %q", out.String())
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// uninterpolated lists the reserved keys whose values are not
+// subject to interpolation: they hold metadata and state that are
+// managed by package infra.
+var uninterpolated = map[string]bool{
+	"versions":  true,
+	"instances": true,
+	"outputs":   true,
+	infraKey:    true,
+}
+
+// A reference records a string value that was interpolated: the
+// raw value at path in the configuration keys, and the value to
+// which it was resolved.
+type reference struct {
+	path  []string
+	raw   string
+	value interface{}
+}
+
+// interpolator resolves references of the form ${kind:ref} in the
+// values of a set of configuration keys, as documented in
+// Schema.Unmarshal. Resolved references are memoized.
+type interpolator struct {
+	keys     Keys
+	resolved map[string]interface{}
+	visiting map[string]bool
+	trail    []string
+	refs     []reference
+}
+
+// interpolate resolves the references in the values of keys in
+// place. It returns the interpolated values, so that their raw
+// values may be restored when the keys are marshaled; see restore.
+func interpolate(keys Keys) ([]reference, error) {
+	in := &interpolator{
+		keys:     keys,
+		resolved: make(map[string]interface{}),
+		visiting: make(map[string]bool),
+	}
+	// Keys are interpolated in order, so that errors are
+	// deterministic.
+	for _, k := range sortedKeys(keys) {
+		if uninterpolated[k] {
+			continue
+		}
+		v, err := in.value(keys[k], []string{k})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		keys[k] = v
+	}
+	return in.refs, nil
+}
+
+// value returns the value v with references resolved. If path is
+// non-nil, it is the path of v in the interpolated keys, and the
+// interpolated strings in v are recorded. Strings in lists are not
+// recorded.
+func (in *interpolator) value(v interface{}, path []string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		w, err := in.string(v)
+		if err == nil && path != nil && strings.Contains(v, "${") {
+			in.refs = append(in.refs, reference{path, v, w})
+		}
+		return w, err
+	case map[interface{}]interface{}:
+		keys := make([]interface{}, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			w, err := in.value(v[k], subpath(path, fmt.Sprint(k)))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			v[k] = w
+		}
+	case Keys:
+		for _, k := range sortedKeys(v) {
+			w, err := in.value(v[k], subpath(path, k))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			v[k] = w
+		}
+	case []interface{}:
+		for i, w := range v {
+			w, err := in.value(w, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", i, err)
+			}
+			v[i] = w
+		}
+	}
+	return v, nil
+}
+
+// subpath returns the path of the element elem of the value at
+// path, or nil if path is nil.
+func subpath(path []string, elem string) []string {
+	if path == nil {
+		return nil
+	}
+	return append(path[:len(path):len(path)], elem)
+}
+
+// sortedKeys returns the keys of k in sorted order.
+func sortedKeys(k Keys) []string {
+	names := make([]string, 0, len(k))
+	for name := range k {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// restore restores the raw values of the provided references in the
+// marshaled keys, replacing the values that are still equal to the
+// values to which they were resolved. Values that are not YAML
+// trees are converted to trees as needed.
+func restore(keys Keys, refs []reference) error {
+	for _, ref := range refs {
+		v, ok := keys[ref.path[0]]
+		if !ok {
+			continue
+		}
+		if len(ref.path) > 1 {
+			switch v.(type) {
+			case map[interface{}]interface{}, map[string]interface{}, Keys:
+			default:
+				var tree interface{}
+				if err := remarshal(v, &tree); err != nil {
+					return err
+				}
+				v = tree
+			}
+		}
+		v, err := rewrite(v, ref.path[1:], func(v interface{}) (interface{}, error) {
+			if fmt.Sprint(v) != fmt.Sprint(ref.value) {
+				return v, nil
+			}
+			return ref.raw, nil
+		})
+		if err != nil {
+			return err
+		}
+		keys[ref.path[0]] = v
+	}
+	return nil
+}
+
+// string resolves the references in the string s. If s consists of
+// a single reference, then the referenced value is returned as-is,
+// so that non-string values retain their type.
+func (in *interpolator) string(s string) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var (
+		b     strings.Builder
+		parts int
+		value interface{}
+	)
+	for len(s) > 0 {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			parts++
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			parts += 2
+			continue
+		}
+		if i > 0 {
+			b.WriteString(s[:i])
+			parts++
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated reference in %q", s)
+		}
+		ref := s[i+2 : i+j]
+		v, err := in.resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		value = v
+		fmt.Fprint(&b, v)
+		parts++
+		s = s[i+j+1:]
+	}
+	if parts == 1 && value != nil {
+		return value, nil
+	}
+	return b.String(), nil
+}
+
+// resolve returns the value of the provided reference.
+func (in *interpolator) resolve(ref string) (interface{}, error) {
+	if v, ok := in.resolved[ref]; ok {
+		return v, nil
+	}
+	if in.visiting[ref] {
+		return nil, fmt.Errorf("reference cycle: %s -> %s", strings.Join(in.trail, " -> "), ref)
+	}
+	in.visiting[ref] = true
+	in.trail = append(in.trail, ref)
+	defer func() {
+		delete(in.visiting, ref)
+		in.trail = in.trail[:len(in.trail)-1]
+	}()
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed reference ${%s}: expected ${kind:name}", ref)
+	}
+	var (
+		v   interface{}
+		err error
+	)
+	switch kind, name := parts[0], parts[1]; kind {
+	case "env":
+		var ok bool
+		v, ok = os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("${%s}: environment variable %s is not set", ref, name)
+		}
+	case "key":
+		v, err = in.lookup(in.keys, strings.Split(name, "."))
+		if err != nil {
+			err = fmt.Errorf("${%s}: %v", ref, err)
+		}
+	case "output":
+		path := strings.Split(name, ".")
+		impl := path[0]
+		if provider, ok := in.keys[impl].(string); ok {
+			impl = providerName(provider)
+		}
+		var outputs interface{}
+		outputs, err = in.lookup(in.keys, []string{"outputs", impl})
+		if err == nil {
+			v, err = in.lookup(outputs, path[1:])
+		}
+		if err != nil {
+			err = fmt.Errorf("${%s}: %v", ref, err)
+		}
+	default:
+		err = fmt.Errorf("${%s}: unknown reference kind %q", ref, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case map[interface{}]interface{}, Keys, []interface{}:
+		return nil, fmt.Errorf("${%s}: reference to non-scalar value", ref)
+	}
+	if v, err = in.value(v, nil); err != nil {
+		return nil, err
+	}
+	in.resolved[ref] = v
+	return v, nil
+}
+
+// lookup returns the value at the provided path in v.
+func (in *interpolator) lookup(v interface{}, path []string) (interface{}, error) {
+	for i, elem := range path {
+		var (
+			w  interface{}
+			ok bool
+		)
+		switch m := v.(type) {
+		case Keys:
+			w, ok = m[elem]
+		case map[interface{}]interface{}:
+			w, ok = m[elem]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s not defined", strings.Join(path[:i+1], "."))
+		}
+		v = w
+	}
+	return v, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("INFRA_TEST_USER", "envuser")
+	defer os.Unsetenv("INFRA_TEST_USER")
+	schema := infra.Schema{
+		"creds":   new(testCreds),
+		"cluster": new(testCluster),
+		"queue":   new(testQueue),
+	}
+	config, err := schema.Unmarshal([]byte(`creds: testcreds,user=${env:INFRA_TEST_USER}
+cluster: testcluster
+queue: testqueue
+size: 8
+prefix: ${key:name}-prod
+name: jobs
+testcluster:
+  instance_type: ${key:prefix}.${output:queue.arn}
+  num_instances: ${key:size}
+  setup_user: $${literal}
+outputs:
+  testqueue:
+    arn: queuearn
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cluster *testCluster
+	config.Must(&cluster)
+	if got, want := cluster.User, "envuser"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.InstanceType, "jobs-prod.queuearn"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.NumInstances, 8; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.SetupUser, "${literal}"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInterpolateMarshal(t *testing.T) {
+	os.Setenv("INFRA_TEST_TYPE", "envtype")
+	defer os.Unsetenv("INFRA_TEST_TYPE")
+	schema := infra.Schema{
+		"creds":   new(testCreds),
+		"cluster": new(testCluster),
+	}
+	config, err := schema.Unmarshal([]byte(`creds: testcreds,user=${key:user}
+cluster: testcluster
+user: xyz
+size: 8
+testcluster:
+  instance_type: ${env:INFRA_TEST_TYPE}-large
+  num_instances: ${key:size}
+  setup_user: $${literal}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"creds: testcreds,user=${key:user}\n",
+		"  instance_type: ${env:INFRA_TEST_TYPE}-large\n",
+		"  num_instances: ${key:size}\n",
+		"  setup_user: $${literal}\n",
+	} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+	if strings.Contains(string(p), "envtype") {
+		t.Errorf("marshaled config %s contains interpolated environment variable", p)
+	}
+	// Round trips are stable.
+	os.Setenv("INFRA_TEST_TYPE", "othertype")
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cluster *testCluster
+	config.Must(&cluster)
+	if got, want := cluster.InstanceType, "othertype-large"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.SetupUser, "${literal}"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	os.Setenv("INFRA_TEST_TYPE", "envtype")
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(q), string(p); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Values changed since they were interpolated are marshaled as
+	// they are.
+	config.Must(&cluster)
+	cluster.NumInstances = 16
+	if q, err = config.Marshal(false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(q), "  num_instances: 16\n") {
+		t.Errorf("marshaled config %s does not contain the changed value", q)
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	schema := infra.Schema{"creds": new(testCreds)}
+	for _, c := range []struct {
+		config, err string
+	}{
+		{"creds: ${key:a}\na: ${key:b}\nb: ${key:a}\n", "a: reference cycle: key:b -> key:a -> key:b"},
+		{"creds: ${key:missing}\n", "creds: ${key:missing}: missing not defined"},
+		{"creds: ${env:INFRA_TEST_UNSET}\n", "creds: ${env:INFRA_TEST_UNSET}: environment variable INFRA_TEST_UNSET is not set"},
+		{"creds: ${bogus:x}\n", `creds: ${bogus:x}: unknown reference kind "bogus"`},
+		{"creds: ${key:a\n", `creds: unterminated reference in "${key:a"`},
+		{"creds: ${output:creds.x}\n", "creds: ${output:creds.x}: outputs not defined"},
+		{"creds: testcreds\nnested:\n  b: ${key:missingb}\n  a: ${key:missinga}\n", "nested: a: ${key:missinga}: missinga not defined"},
+	} {
+		_, err := schema.Unmarshal([]byte(c.config))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, want %v", c.config, err, c.err)
+		}
+	}
+}
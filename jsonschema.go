@@ -0,0 +1,232 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var (
+	typeOfDuration      = reflect.TypeOf(time.Duration(0))
+	typeOfYAMLMarshaler = reflect.TypeOf((*yaml.Marshaler)(nil)).Elem()
+)
+
+// JSONSchema returns a JSON Schema (draft-07) document that
+// describes configurations of the schema s, suitable for use by
+// editors to validate and complete YAML configuration files.
+//
+// Each schema key is described as a string that must name one of
+// the providers registered in DefaultRegistry that are
+// type-compatible with the key, optionally followed by that
+// provider's flags. Each such provider's
+// configuration (as returned by its Config method) is described by
+// reflecting over its type, using the same field names as the YAML
+// encoding. Instance configurations and provider outputs are
+// described under the "instances" and "outputs" keys.
+func (s Schema) JSONSchema() ([]byte, error) {
+	return s.JSONSchemaWithRegistry(DefaultRegistry)
+}
+
+// JSONSchemaWithRegistry returns a JSON Schema document that
+// describes configurations of the schema s as in JSONSchema, with
+// the providers registered in the registry reg instead of
+// DefaultRegistry.
+func (s Schema) JSONSchemaWithRegistry(reg *Registry) ([]byte, error) {
+	if err := s.checkReserved(); err != nil {
+		return nil, err
+	}
+	var (
+		types     = s.types()
+		props     = make(map[string]interface{})
+		instances = make(map[string]interface{})
+		outputs   = make(map[string]interface{})
+		seen      = make(map[string]bool)
+	)
+	for typ, key := range types {
+		var (
+			choices []interface{}
+			names   []string
+		)
+		for _, p := range reg.registered() {
+			field, ok := assign(p.Type(), typ)
+			if !ok {
+				continue
+			}
+			names = append(names, regexp.QuoteMeta(p.name))
+			inst := p.New(Config{}, field)
+			choices = append(choices, providerJSONSchema(p.name, inst))
+			if seen[p.name] {
+				continue
+			}
+			seen[p.name] = true
+			if config := inst.Config(); config != nil {
+				props[p.name] = jsonSchemaOf(reflect.TypeOf(config), nil)
+			}
+			if config := inst.InstanceConfig(); config != nil {
+				instances[p.name] = jsonSchemaOf(reflect.TypeOf(config), nil)
+			}
+			if output := inst.Outputs(); output != nil {
+				outputs[p.name] = jsonSchemaOf(reflect.TypeOf(output), nil)
+			}
+		}
+		prop := map[string]interface{}{
+			"type":        "string",
+			"description": fmt.Sprintf("provider for values of type %s", typ),
+		}
+		if len(choices) > 0 {
+			prop["anyOf"] = append(choices, firstOfJSONSchema(names))
+		}
+		props[key] = prop
+	}
+	props["versions"] = map[string]interface{}{
+		"type":                 "object",
+		"description":          "provider versions that have been set up",
+		"additionalProperties": map[string]interface{}{"type": "integer"},
+	}
+	props["instances"] = map[string]interface{}{
+		"type":        "object",
+		"description": "marshaled provider instances",
+		"properties":  instances,
+	}
+	props["outputs"] = map[string]interface{}{
+		"type":        "object",
+		"description": "provider outputs",
+		"properties":  outputs,
+	}
+	props[infraKey] = map[string]interface{}{
+		"type":        "object",
+		"description": "configuration format metadata",
+		"properties": map[string]interface{}{
+			"version": map[string]interface{}{"type": "integer"},
+		},
+	}
+	doc := map[string]interface{}{
+		"$schema":    jsonSchemaDraft,
+		"type":       "object",
+		"properties": props,
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// providerJSONSchema returns the JSON schema that matches a
+// configuration key's value selecting the provider with the given
+// name, with any of the flags defined by the provider, optionally
+// followed by decorators (see RegisterDecorator).
+func providerJSONSchema(name string, inst *instance) map[string]interface{} {
+	var (
+		flags []string
+		help  []string
+	)
+	if text := inst.Help(); text != "" {
+		help = append(help, text)
+	}
+	inst.Flags().VisitAll(func(f *flag.Flag) {
+		flags = append(flags, regexp.QuoteMeta(f.Name))
+		line := fmt.Sprintf("%s: %s", f.Name, f.Usage)
+		if f.DefValue != "" {
+			line += fmt.Sprintf(" (default %q)", f.DefValue)
+		}
+		help = append(help, line)
+	})
+	pattern := "^" + regexp.QuoteMeta(name)
+	if len(flags) > 0 {
+		pattern += "(,(" + strings.Join(flags, "|") + ")(=[^,|]*)?)*"
+	}
+	// Decorators, with their flags.
+	pattern += `(\|[a-z0-9_-]+(,[^,|]*)*)*$`
+	schema := map[string]interface{}{
+		"title":   name,
+		"pattern": pattern,
+	}
+	if len(help) > 0 {
+		schema["description"] = strings.Join(help, "\n")
+	}
+	return schema
+}
+
+// firstOfJSONSchema returns the JSON schema that matches a
+// configuration key's value selecting the first of the named
+// providers that initializes successfully, optionally followed by
+// decorators.
+func firstOfJSONSchema(names []string) map[string]interface{} {
+	name := `\s*(` + strings.Join(names, "|") + `)\s*`
+	return map[string]interface{}{
+		"title":       firstOfName,
+		"pattern":     `^` + firstOfName + `\(` + name + `(,` + name + `)*\)(\|[a-z0-9_-]+(,[^,|]*)*)*$`,
+		"description": "the first of the listed providers that initializes successfully",
+	}
+}
+
+// jsonSchemaOf returns a JSON schema describing the YAML encoding of
+// values of type typ. Recursive types are described only up to their
+// first recurrence.
+func jsonSchemaOf(typ reflect.Type, visiting map[reflect.Type]bool) map[string]interface{} {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == typeOfDuration {
+		return map[string]interface{}{"type": "string"}
+	}
+	// Types that marshal themselves may take any value.
+	if reflect.PtrTo(typ).Implements(typeOfYAMLMarshaler) {
+		return map[string]interface{}{}
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"}
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaOf(typ.Elem(), visiting),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchemaOf(typ.Elem(), visiting),
+		}
+	case reflect.Struct:
+		if visiting[typ] {
+			return map[string]interface{}{"type": "object"}
+		}
+		if visiting == nil {
+			visiting = make(map[reflect.Type]bool)
+		}
+		visiting[typ] = true
+		defer delete(visiting, typ)
+		fields := configFields(typ)
+		props := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			props[f.Name] = jsonSchemaOf(f.Type, visiting)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	default:
+		// Interfaces and other dynamic types may take any value.
+		return map[string]interface{}{}
+	}
+}
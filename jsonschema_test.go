@@ -0,0 +1,127 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestJSONSchema(t *testing.T) {
+	p, err := schema.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Properties map[string]struct {
+			Type       string
+			AnyOf      []struct{ Title, Pattern string }
+			Properties map[string]struct{ Type string }
+		}
+	}
+	if err := json.Unmarshal(p, &doc); err != nil {
+		t.Fatal(err)
+	}
+	creds := doc.Properties["creds"]
+	if got, want := creds.Type, "string"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(creds.AnyOf), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := creds.AnyOf[0].Title, "testcreds"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	pattern := regexp.MustCompile(creds.AnyOf[0].Pattern)
+	for _, s := range []string{"testcreds", "testcreds,user=xyz", "testcreds,user", "testcreds,user=xyz|cached,size=1g"} {
+		if !pattern.MatchString(s) {
+			t.Errorf("pattern %s does not match %s", pattern, s)
+		}
+	}
+	for _, s := range []string{"testcluster", "testcreds,bad=xyz", "testcredsx"} {
+		if pattern.MatchString(s) {
+			t.Errorf("pattern %s unexpectedly matches %s", pattern, s)
+		}
+	}
+	if got, want := creds.AnyOf[1].Title, "firstof"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	pattern = regexp.MustCompile(creds.AnyOf[1].Pattern)
+	if s := "firstof(testcreds, testcreds)|cached"; !pattern.MatchString(s) {
+		t.Errorf("pattern %s does not match %s", pattern, s)
+	}
+	if s := "firstof(testcluster)"; pattern.MatchString(s) {
+		t.Errorf("pattern %s unexpectedly matches %s", pattern, s)
+	}
+
+	cluster := doc.Properties["testcluster"]
+	if got, want := cluster.Type, "object"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	fields := make(map[string]string)
+	for name, prop := range cluster.Properties {
+		fields[name] = prop.Type
+	}
+	if got, want := fields, map[string]string{
+		"instance_type": "string",
+		"num_instances": "integer",
+		"setup_user":    "string",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := doc.Properties["testcreds"].Type, "string"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := doc.Properties["versions"].Type, "object"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := doc.Properties["instances"].Properties["testcluster"]; !ok {
+		t.Error("missing instance config for testcluster")
+	}
+}
+
+func TestJSONSchemaWithRegistry(t *testing.T) {
+	reg := infra.NewRegistry()
+	reg.Register("testcreds", new(testOtherCreds))
+	schema := infra.Schema{"creds": new(testOtherCreds)}
+	p, err := schema.JSONSchemaWithRegistry(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Properties map[string]struct {
+			AnyOf []struct{ Title string }
+		}
+	}
+	if err := json.Unmarshal(p, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, s := range doc.Properties["creds"].AnyOf {
+		titles = append(titles, s.Title)
+	}
+	if got, want := titles, []string{"testcreds", "firstof"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := doc.Properties["testcluster"]; ok {
+		t.Error("schema includes providers from the default registry")
+	}
+	// The default registry has no providers for the key.
+	p, err = schema.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Properties = nil
+	if err := json.Unmarshal(p, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(doc.Properties["creds"].AnyOf); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// infraKey is the reserved key under which package infra stores its
+// own metadata in configuration documents.
+const infraKey = "infra"
+
+type migration struct {
+	to int
+	fn func(Keys) (Keys, error)
+}
+
+// schemaMigrations holds the migrations registered for each schema.
+// Schemas are maps, and so cannot carry migrations themselves
+// without exposing them to the schema's users; migrations are
+// instead kept here, keyed by the identity of the schema's map.
+// Entries retain their schemas, so that identities are not reused.
+var schemaMigrations = struct {
+	sync.Mutex
+	m map[uintptr]*migrations
+}{m: make(map[uintptr]*migrations)}
+
+// migrations are the migrations registered for a schema.
+type migrations struct {
+	schema Schema
+	m      map[int]migration
+}
+
+// migrations returns the migrations registered for the schema s, or
+// nil if none are. If create is true, an empty set of migrations is
+// returned instead of nil. The caller must hold schemaMigrations.
+func (s Schema) migrations(create bool) *migrations {
+	id := reflect.ValueOf(s).Pointer()
+	ms := schemaMigrations.m[id]
+	if ms == nil && create {
+		ms = &migrations{schema: s, m: make(map[int]migration)}
+		schemaMigrations.m[id] = ms
+	}
+	return ms
+}
+
+// RegisterMigration registers a document migration for the schema s
+// from format version from to format version to. Migrations are
+// applied by Schema.Unmarshal to documents with older format
+// versions, in order, until the document is at the schema's format
+// version. The schema's format version is the largest version to
+// which a migration is registered; it is 0 if the schema has no
+// migrations. Documents without a format version are taken to be at
+// version 0. Migrations belong to the schema (that is, to its map)
+// and apply only to documents unmarshaled with it; the schema map
+// itself is not modified.
+//
+// Migrations are used to rename schema keys or to restructure
+// provider configurations, so that previously marshaled
+// configurations may still be restored. Migrations may modify the
+// provided keys in place. RegisterMigration panics if to is not
+// greater than from, or if a migration from version from is already
+// registered.
+func (s Schema) RegisterMigration(from, to int, fn func(Keys) (Keys, error)) {
+	if to <= from {
+		panic(fmt.Sprintf("infra.RegisterMigration: invalid migration from version %d to %d", from, to))
+	}
+	schemaMigrations.Lock()
+	defer schemaMigrations.Unlock()
+	ms := s.migrations(true)
+	if _, ok := ms.m[from]; ok {
+		panic(fmt.Sprintf("infra.RegisterMigration: migration from version %d already registered", from))
+	}
+	ms.m[from] = migration{to, fn}
+}
+
+// FormatVersion returns the schema's current document format
+// version.
+func (s Schema) FormatVersion() int {
+	schemaMigrations.Lock()
+	defer schemaMigrations.Unlock()
+	ms := s.migrations(false)
+	if ms == nil {
+		return 0
+	}
+	var version int
+	for _, m := range ms.m {
+		if m.to > version {
+			version = m.to
+		}
+	}
+	return version
+}
+
+// migrate applies the schema's migrations to the provided keys,
+// returning keys at the schema's current format version.
+func (s Schema) migrate(keys Keys) (Keys, error) {
+	version, err := formatVersion(keys)
+	if err != nil {
+		return nil, err
+	}
+	current := s.FormatVersion()
+	if version > current {
+		return nil, fmt.Errorf("config format version %d is newer than the supported version %d", version, current)
+	}
+	for version < current {
+		schemaMigrations.Lock()
+		m, ok := s.migrations(true).m[version]
+		schemaMigrations.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no migration from config format version %d", version)
+		}
+		if keys, err = m.fn(keys); err != nil {
+			return nil, fmt.Errorf("migrate config from format version %d to %d: %v", version, m.to, err)
+		}
+		version = m.to
+	}
+	return keys, nil
+}
+
+// formatVersion returns the format version of the document
+// represented by keys.
+func formatVersion(keys Keys) (int, error) {
+	meta, ok, err := keys.Keys(infraKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	version, _, err := meta.Int("version")
+	return version, err
+}
+
+// setFormatVersion records the schema's format version in keys,
+// preserving any other metadata. The version is omitted for schemas
+// without migrations.
+func (s Schema) setFormatVersion(keys Keys) {
+	version := s.FormatVersion()
+	if version == 0 {
+		return
+	}
+	meta, _ := keys[infraKey].(map[interface{}]interface{})
+	if meta == nil {
+		meta = make(map[interface{}]interface{})
+		keys[infraKey] = meta
+	}
+	meta["version"] = version
+}
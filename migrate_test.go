@@ -0,0 +1,151 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestMigration(t *testing.T) {
+	schema := infra.Schema{
+		"creds":   new(testCreds),
+		"cluster": new(testCluster),
+	}
+	// Version 1 renamed the key "user" to "creds".
+	schema.RegisterMigration(0, 1, func(keys infra.Keys) (infra.Keys, error) {
+		keys["creds"] = keys["user"]
+		delete(keys, "user")
+		return keys, nil
+	})
+	// Version 2 renamed the cluster's "type" field to "instance_type".
+	schema.RegisterMigration(1, 2, func(keys infra.Keys) (infra.Keys, error) {
+		cluster, _, err := keys.Keys("testcluster")
+		if err != nil {
+			return nil, err
+		}
+		if cluster != nil {
+			cluster["instance_type"] = cluster["type"]
+			delete(cluster, "type")
+			keys["testcluster"] = cluster
+		}
+		return keys, nil
+	})
+	if got, want := schema.FormatVersion(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	config, err := schema.Unmarshal([]byte(`user: testcreds,user=old
+cluster: testcluster
+testcluster:
+  type: abc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cluster *testCluster
+	config.Must(&cluster)
+	if got, want := cluster.User, "old"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cluster.InstanceType, "abc"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "infra:\n  version: 2\n") {
+		t.Errorf("marshaled config %s is missing format version", p)
+	}
+	// Migrations are not reapplied to current documents.
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Must(&cluster)
+	if got, want := cluster.InstanceType, "abc"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = schema.Unmarshal([]byte("infra:\n  version: 3\n"))
+	if err == nil || !strings.Contains(err.Error(), "newer than the supported version 2") {
+		t.Errorf("expected version error, got %v", err)
+	}
+}
+
+func TestMigrationMissing(t *testing.T) {
+	schema := infra.Schema{"creds": new(testCreds)}
+	schema.RegisterMigration(1, 2, func(keys infra.Keys) (infra.Keys, error) {
+		return keys, nil
+	})
+	_, err := schema.Unmarshal([]byte("creds: testcreds\n"))
+	if err == nil || err.Error() != "no migration from config format version 0" {
+		t.Errorf("expected missing migration error, got %v", err)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic")
+		}
+	}()
+	schema.RegisterMigration(1, 3, func(keys infra.Keys) (infra.Keys, error) {
+		return keys, nil
+	})
+}
+
+func TestMigrationSchemaUnchanged(t *testing.T) {
+	schema := infra.Schema{"creds": new(testCreds)}
+	schema.RegisterMigration(0, 1, func(keys infra.Keys) (infra.Keys, error) {
+		return keys, nil
+	})
+	if got, want := len(schema), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Documents unmarshaled with other schemas are not migrated.
+	other := infra.Schema{"creds": new(testCreds)}
+	if got, want := other.FormatVersion(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	config, err := other.Unmarshal([]byte("creds: testcreds\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "version: 1") {
+		t.Errorf("marshaled config %s has unexpected format version", p)
+	}
+	// Child configs retain their parent's format version.
+	config, err = schema.Unmarshal([]byte("creds: testcreds\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := config.With(infra.Keys{"creds": "testcreds,user=child"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = child.Marshal(false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "infra:\n  version: 1\n") {
+		t.Errorf("marshaled config %s is missing format version", p)
+	}
+}
+
+func TestSchemaReservedKey(t *testing.T) {
+	schema := infra.Schema{
+		"creds": new(testCreds),
+		"infra": new(testCluster),
+	}
+	if _, err := schema.Make(infra.Keys{"creds": "testcreds"}); err == nil || err.Error() != "schema key infra is reserved" {
+		t.Errorf("got %v, want reserved key error", err)
+	}
+	if _, err := schema.JSONSchema(); err == nil {
+		t.Error("expected error")
+	}
+}
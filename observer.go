@@ -0,0 +1,222 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// An Event describes a step in the lifecycle of a configuration's
+// providers, as reported to an Observer.
+type Event struct {
+	// Key is the schema key of the instance. It is empty for
+	// marshal events.
+	Key string
+	// Provider is the name of the instance's provider. It is empty
+	// for marshal events.
+	Provider string
+	// FromVersion and ToVersion are, for setup events, the
+	// instance's configured version before setup and the version
+	// that setup brings it to. FromVersion is -1 if the instance
+	// was never set up.
+	FromVersion, ToVersion int
+	// Duration is the duration of the step. It is set for end and
+	// marshal events.
+	Duration time.Duration
+	// Err is the error, if any, that resulted from the step. It is
+	// set for end and marshal events.
+	Err error
+
+	// inst is the instance, which tells apart the instances of
+	// configs that share an observer (see With).
+	inst *instance
+}
+
+// An Observer is notified of lifecycle events of a configuration's
+// providers: their initialization and setup, and the marshaling of
+// the configuration. Observers may be called concurrently.
+type Observer interface {
+	// OnInitStart is called before an instance's Init method is
+	// called, once its requirements have been initialized.
+	OnInitStart(Event)
+	// OnInitEnd is called after an instance's Init method
+	// returns, including any retries.
+	OnInitEnd(Event)
+	// OnSetupStart is called before an instance's Setup method is
+	// called.
+	OnSetupStart(Event)
+	// OnSetupEnd is called after an instance's Setup method
+	// returns, including any retries.
+	OnSetupEnd(Event)
+	// OnMarshal is called after the configuration is marshaled.
+	OnMarshal(Event)
+}
+
+// observerValue wraps an Observer so that it may be stored in an
+// atomic.Value.
+type observerValue struct{ Observer }
+
+// SetObserver sets the observer that is notified of the lifecycle
+// events of the configuration's providers. A nil observer disables
+// notifications. Eager instances are initialized by Make, before an
+// observer can be set.
+func (c Config) SetObserver(obs Observer) {
+	defer c.lock()()
+	c.observer.Store(observerValue{obs})
+}
+
+// getObserver returns the config's observer, or nil.
+func (c Config) getObserver() Observer {
+	if c.observer == nil {
+		return nil
+	}
+	v, _ := c.observer.Load().(observerValue)
+	return v.Observer
+}
+
+// observed calls fn, reporting its start and end to the observer of
+// the instance's configuration (if any) through the provided
+// Observer methods.
+func (inst *instance) observed(ev Event, start, end func(Observer, Event), fn func() error) error {
+	obs := inst.config.getObserver()
+	if obs == nil {
+		return fn()
+	}
+	ev.Key, ev.Provider, ev.inst = inst.config.key(inst), inst.Impl(), inst
+	start(obs, ev)
+	begin := time.Now()
+	err := fn()
+	ev.Duration, ev.Err = time.Since(begin), err
+	end(obs, ev)
+	return err
+}
+
+// LogObserver is an Observer that logs lifecycle events using
+// package github.com/grailbio/base/log. Start events, successful
+// initializations, and marshaling are logged at the debug level;
+// successful setups at the info level; failures at the error level.
+type LogObserver struct{}
+
+// OnInitStart implements Observer.
+func (LogObserver) OnInitStart(ev Event) {
+	log.Debug.Printf("infra: init %s (%s)", ev.Key, ev.Provider)
+}
+
+// OnInitEnd implements Observer.
+func (LogObserver) OnInitEnd(ev Event) {
+	if ev.Err != nil {
+		log.Error.Printf("infra: init %s (%s) failed after %s: %v", ev.Key, ev.Provider, ev.Duration, ev.Err)
+		return
+	}
+	log.Debug.Printf("infra: init %s (%s) done in %s", ev.Key, ev.Provider, ev.Duration)
+}
+
+// OnSetupStart implements Observer.
+func (LogObserver) OnSetupStart(ev Event) {
+	log.Debug.Printf("infra: setup %s (%s) version %d -> %d", ev.Key, ev.Provider, ev.FromVersion, ev.ToVersion)
+}
+
+// OnSetupEnd implements Observer.
+func (LogObserver) OnSetupEnd(ev Event) {
+	if ev.Err != nil {
+		log.Error.Printf("infra: setup %s (%s) version %d -> %d failed after %s: %v", ev.Key, ev.Provider, ev.FromVersion, ev.ToVersion, ev.Duration, ev.Err)
+		return
+	}
+	log.Printf("infra: setup %s (%s) version %d -> %d done in %s", ev.Key, ev.Provider, ev.FromVersion, ev.ToVersion, ev.Duration)
+}
+
+// OnMarshal implements Observer.
+func (LogObserver) OnMarshal(ev Event) {
+	if ev.Err != nil {
+		log.Error.Printf("infra: marshal failed: %v", ev.Err)
+		return
+	}
+	log.Debug.Printf("infra: marshal done in %s", ev.Duration)
+}
+
+// A Span is a traced operation, modeled after OpenTelemetry spans.
+type Span interface {
+	// SetAttribute sets an attribute of the span.
+	SetAttribute(key string, value interface{})
+	// RecordError records an error that occurred during the span.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// A Tracer starts spans, modeled after OpenTelemetry tracers.
+// Adapters for specific tracing systems implement Tracer.
+type Tracer interface {
+	// Start starts a new span with the provided name.
+	Start(name string) Span
+}
+
+// SpanObserver returns an Observer that traces provider lifecycle
+// events as spans of the provided tracer. Init and setup steps are
+// traced as spans named "infra.init" and "infra.setup". Marshaling
+// is reported only once it is done; it is traced as a span named
+// "infra.marshal" that carries the marshaling's duration (a
+// time.Duration) as the attribute "infra.duration". Init and setup
+// spans carry the attributes "infra.key", "infra.provider", and, for
+// setup, "infra.version.from" and "infra.version.to".
+func SpanObserver(tracer Tracer) Observer {
+	return &spanObserver{tracer: tracer, spans: make(map[spanKey]Span)}
+}
+
+type spanKey struct {
+	name, key string
+	inst      *instance
+}
+
+type spanObserver struct {
+	tracer Tracer
+	mu     sync.Mutex
+	spans  map[spanKey]Span
+}
+
+func (o *spanObserver) start(name string, ev Event) {
+	span := o.tracer.Start(name)
+	span.SetAttribute("infra.key", ev.Key)
+	span.SetAttribute("infra.provider", ev.Provider)
+	if name == "infra.setup" {
+		span.SetAttribute("infra.version.from", ev.FromVersion)
+		span.SetAttribute("infra.version.to", ev.ToVersion)
+	}
+	o.mu.Lock()
+	o.spans[spanKey{name, ev.Key, ev.inst}] = span
+	o.mu.Unlock()
+}
+
+func (o *spanObserver) end(name string, ev Event) {
+	k := spanKey{name, ev.Key, ev.inst}
+	o.mu.Lock()
+	span := o.spans[k]
+	delete(o.spans, k)
+	o.mu.Unlock()
+	if span == nil {
+		return
+	}
+	if ev.Err != nil {
+		span.RecordError(ev.Err)
+	}
+	span.End()
+}
+
+func (o *spanObserver) OnInitStart(ev Event)  { o.start("infra.init", ev) }
+func (o *spanObserver) OnInitEnd(ev Event)    { o.end("infra.init", ev) }
+func (o *spanObserver) OnSetupStart(ev Event) { o.start("infra.setup", ev) }
+func (o *spanObserver) OnSetupEnd(ev Event)   { o.end("infra.setup", ev) }
+
+func (o *spanObserver) OnMarshal(ev Event) {
+	span := o.tracer.Start("infra.marshal")
+	span.SetAttribute("infra.duration", ev.Duration)
+	if ev.Err != nil {
+		span.RecordError(ev.Err)
+	}
+	span.End()
+}
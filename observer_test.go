@@ -0,0 +1,200 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/infra"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(kind string, ev infra.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := fmt.Sprintf("%s %s %s", kind, ev.Key, ev.Provider)
+	if kind == "setup-start" || kind == "setup-end" {
+		s += fmt.Sprintf(" %d->%d", ev.FromVersion, ev.ToVersion)
+	}
+	if ev.Err != nil {
+		s += " error"
+	}
+	o.events = append(o.events, s)
+}
+
+func (o *recordingObserver) OnInitStart(ev infra.Event)  { o.record("init-start", ev) }
+func (o *recordingObserver) OnInitEnd(ev infra.Event)    { o.record("init-end", ev) }
+func (o *recordingObserver) OnSetupStart(ev infra.Event) { o.record("setup-start", ev) }
+func (o *recordingObserver) OnSetupEnd(ev infra.Event)   { o.record("setup-end", ev) }
+func (o *recordingObserver) OnMarshal(ev infra.Event)    { o.record("marshal", ev) }
+
+func TestObserver(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := new(recordingObserver)
+	config.SetObserver(obs)
+	var cluster *testCluster
+	config.Must(&cluster)
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Marshal(false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"init-start creds testcreds",
+		"init-end creds testcreds",
+		"init-start cluster testcluster",
+		"init-end cluster testcluster",
+		"setup-start cluster testcluster -1->1",
+		"setup-end cluster testcluster -1->1",
+		"marshal  ",
+	}
+	if got := obs.events; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	attrs  map[string]interface{}
+	err    error
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) RecordError(err error)                      { s.err = err }
+
+func (s *testSpan) End() {
+	s.tracer.mu.Lock()
+	s.tracer.ended = append(s.tracer.ended, s)
+	s.tracer.mu.Unlock()
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	ended []*testSpan
+}
+
+func (t *testTracer) Start(name string) infra.Span {
+	return &testSpan{tracer: t, name: name, attrs: make(map[string]interface{})}
+}
+
+func TestSpanObserver(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := new(testTracer)
+	config.SetObserver(infra.SpanObserver(tracer))
+	if err := config.Setup(); err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := len(tracer.ended), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	span := tracer.ended[1]
+	if got, want := span.name, "infra.setup"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if span.err == nil {
+		t.Error("expected span error")
+	}
+	want := map[string]interface{}{
+		"infra.key":          "cluster",
+		"infra.provider":     "testcluster",
+		"infra.version.from": -1,
+		"infra.version.to":   1,
+	}
+	if got := span.attrs; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := config.Marshal(false); err != nil {
+		t.Fatal(err)
+	}
+	span = tracer.ended[len(tracer.ended)-1]
+	if got, want := span.name, "infra.marshal"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if d, ok := span.attrs["infra.duration"].(time.Duration); !ok || d <= 0 {
+		t.Errorf("got duration %v, want positive duration", span.attrs["infra.duration"])
+	}
+}
+
+// testBarrier blocks initialization until barrier is released.
+type testBarrier struct{}
+
+var barrier sync.WaitGroup
+
+func (*testBarrier) Init(creds *testCreds) error {
+	barrier.Done()
+	barrier.Wait()
+	return nil
+}
+
+func init() {
+	infra.Register("testbarrier", new(testBarrier))
+}
+
+func TestSpanObserverWith(t *testing.T) {
+	schema := infra.Schema{
+		"creds":   new(testCreds),
+		"barrier": new(testBarrier),
+	}
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=parent",
+		"barrier": "testbarrier",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := new(testTracer)
+	config.SetObserver(infra.SpanObserver(tracer))
+	child, err := config.With(infra.Keys{"creds": "testcreds,user=tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The parent's and the child's instances are initialized
+	// concurrently, so that their spans overlap.
+	barrier.Add(2)
+	var wg sync.WaitGroup
+	for _, c := range []infra.Config{config, child} {
+		wg.Add(1)
+		go func(c infra.Config) {
+			defer wg.Done()
+			var b *testBarrier
+			if err := c.Instance(&b); err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	var n int
+	for _, span := range tracer.ended {
+		if span.attrs["infra.key"] == "barrier" {
+			n++
+		}
+	}
+	if got, want := n, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
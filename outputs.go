@@ -0,0 +1,54 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Output stores the outputs of the provider configured for the
+// schema key key into the provided pointer, which must point to a
+// value of the provider's output type (or to a pointer to it).
+// Output does not initialize the provider; outputs are as last
+// computed by the provider or as restored from a marshaled
+// configuration. Output panics if ptr is not pointer-typed.
+func (c Config) Output(key string, ptr interface{}) error {
+	vptr := reflect.ValueOf(ptr)
+	if vptr.Kind() != reflect.Ptr {
+		panic("infra.Output: non-pointer argument")
+	}
+	defer c.rlock()()
+	inst := c.instanceFor(key)
+	if inst == nil {
+		return fmt.Errorf("no provider configured for key %s", key)
+	}
+	outputs := inst.Outputs()
+	if outputs == nil {
+		return fmt.Errorf("provider %s has no outputs", inst.Impl())
+	}
+	v := reflect.ValueOf(outputs)
+	elem := vptr.Elem()
+	switch {
+	case v.Type().AssignableTo(elem.Type()):
+		elem.Set(v)
+	case v.Kind() == reflect.Ptr && v.Type().Elem().AssignableTo(elem.Type()):
+		elem.Set(v.Elem())
+	default:
+		return fmt.Errorf("provider %s outputs type %s, which is incompatible with %s", inst.Impl(), v.Type(), elem.Type())
+	}
+	return nil
+}
+
+// instanceFor returns the instance configured for the provided
+// schema key, or nil if there is none.
+func (c Config) instanceFor(key string) *instance {
+	for typ, k := range c.types {
+		if k == key {
+			return c.instances[typ]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type testQueueOutputs struct {
+	ARN string `yaml:"arn"`
+}
+
+type testQueue struct {
+	Name string `yaml:"name"`
+
+	outputs testQueueOutputs
+}
+
+var testQueueInits int
+
+func (q *testQueue) Init() error {
+	testQueueInits++
+	return nil
+}
+
+func (q *testQueue) Config() interface{} { return q }
+
+func (q *testQueue) Outputs() interface{} { return &q.outputs }
+
+func (q *testQueue) Setup() error {
+	q.outputs.ARN = "arn:queue:" + q.Name
+	return nil
+}
+
+type testQueueConsumer struct {
+	ARN string
+}
+
+func (c *testQueueConsumer) Init(queue *testQueueOutputs) error {
+	c.ARN = queue.ARN
+	return nil
+}
+
+func init() {
+	infra.Register("testqueue", new(testQueue))
+	infra.Register("testqueueconsumer", new(testQueueConsumer))
+}
+
+func TestOutputs(t *testing.T) {
+	schema := infra.Schema{
+		"queue":    new(testQueue),
+		"consumer": new(testQueueConsumer),
+	}
+	config, err := schema.Unmarshal([]byte(`queue: testqueue
+testqueue:
+  name: jobs
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	var outputs testQueueOutputs
+	if err := config.Output("queue", &outputs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := outputs.ARN, "arn:queue:jobs"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "outputs:\n  testqueue:\n    arn: arn:queue:jobs\n") {
+		t.Errorf("marshaled config %s does not contain outputs", p)
+	}
+
+	testQueueInits = 0
+	config, err = schema.Unmarshal(append(p, "consumer: testqueueconsumer\n"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var consumer *testQueueConsumer
+	config.Must(&consumer)
+	if got, want := consumer.ARN, "arn:queue:jobs"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var outputsPtr *testQueueOutputs
+	if err := config.Output("queue", &outputsPtr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := outputsPtr.ARN, "arn:queue:jobs"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := config.Output("consumer", &outputs); err == nil || err.Error() != "provider testqueueconsumer has no outputs" {
+		t.Errorf("unexpected error %v", err)
+	}
+	var wrong string
+	if err := config.Output("queue", &wrong); err == nil {
+		t.Error("expected error")
+	}
+	// The producer was never initialized.
+	if got, want := testQueueInits, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+// A Step is a setup step, as planned by Config.Plan.
+type Step struct {
+	// Key is the schema key of the instance that is set up.
+	Key string
+	// Provider is the name of the instance's provider.
+	Provider string
+	// FromVersion is the version of the instance's current setup,
+	// or -1 if it has not been set up.
+	FromVersion int
+	// ToVersion is the version to which the instance is set up.
+	ToVersion int
+}
+
+// Plan returns the steps that Setup would perform, in order, without
+// performing them: the instances whose providers implement Setup and
+// whose versions are out of date.
+func (c Config) Plan() []Step {
+	defer c.rlock()()
+	var steps []Step
+	for _, inst := range c.order {
+		if !inst.HasSetup() {
+			continue
+		}
+		step := Step{
+			Key:         c.key(inst),
+			Provider:    inst.Impl(),
+			FromVersion: -1,
+			ToVersion:   inst.Version(),
+		}
+		if version, ok := c.versions[inst.Impl()]; ok {
+			if version >= step.ToVersion {
+				continue
+			}
+			step.FromVersion = version
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// Diff returns a line diff from the configuration c to the
+// configuration other, as marshaled by MarshalRedacted: removed lines
+// are prefixed by "-" and added lines by "+". Diff returns an empty
+// string if the configurations are the same.
+func (c Config) Diff(other Config) (string, error) {
+	a, err := c.MarshalRedacted()
+	if err != nil {
+		return "", err
+	}
+	b, err := other.MarshalRedacted()
+	if err != nil {
+		return "", err
+	}
+	return diffLines(string(a), string(b)), nil
+}
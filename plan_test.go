@@ -0,0 +1,83 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestPlan(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+		"versions": map[string]int{
+			"testsetup": 0,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := config.Plan()
+	// Steps are in dependency order; testsetup has no dependencies
+	// and may be ordered anywhere.
+	var cluster, setup infra.Step
+	for _, step := range steps {
+		switch step.Key {
+		case "cluster":
+			cluster = step
+		case "setup":
+			setup = step
+		default:
+			t.Errorf("unexpected step %v", step)
+		}
+	}
+	if got, want := cluster, (infra.Step{Key: "cluster", Provider: "testcluster", FromVersion: -1, ToVersion: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := setup, (infra.Step{Key: "setup", Provider: "testsetup", FromVersion: 0, ToVersion: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if steps := config.Plan(); len(steps) != 0 {
+		t.Errorf("got %v, want no steps", steps)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	keys := infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	}
+	config, err := schema.Make(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := config.Diff(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("got %v, want no diff", diff)
+	}
+	keys["creds"] = "testcreds,user=abc"
+	other, err := schema.Make(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err = config.Diff(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := diff, "-creds: testcreds,user=xyz\n+creds: testcreds,user=abc\n-testcreds: xyz\n+testcreds: abc\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/log"
+)
+
+// PluginPrefix is the prefix of the names of plugin executables: the
+// plugin provider named name is served by the executable named
+// PluginPrefix+name.
+const PluginPrefix = "infra-plugin-"
+
+// Plugin protocol methods.
+const (
+	PluginHelp     = "Help"
+	PluginConfig   = "Config"
+	PluginVersion  = "Version"
+	PluginInit     = "Init"
+	PluginSetup    = "Setup"
+	PluginTeardown = "Teardown"
+)
+
+var typeOfPluginPtr = reflect.TypeOf(new(Plugin))
+
+// SetPluginPath sets the directories in which DefaultRegistry looks
+// for plugin executables. See Registry.SetPluginPath.
+func SetPluginPath(dirs ...string) {
+	DefaultRegistry.SetPluginPath(dirs...)
+}
+
+// SetPluginPath sets the directories in which the registry r looks
+// for plugin executables. Plugins are used for provider names that
+// are not registered in r: the provider named name is served by the
+// executable PluginPrefix+name in the first of the directories that
+// contains it. If no plugin path is set, the directories listed in
+// the environment variable INFRA_PLUGIN_PATH are used. Plugins are
+// never looked up in PATH, so that configurations cannot run
+// arbitrary executables that happen to be installed.
+func (r *Registry) SetPluginPath(dirs ...string) {
+	r.mu.Lock()
+	r.pluginPath = append([]string{}, dirs...)
+	r.mu.Unlock()
+}
+
+// find returns the provider registered with the provided name in r
+// or, if there is none, the plugin provider with that name. find
+// returns nil if neither exists.
+func (r *Registry) find(name string) *provider {
+	if p := r.lookup(name); p != nil {
+		return p
+	}
+	return r.plugin(name)
+}
+
+// plugin returns a provider for the plugin with the provided name,
+// or nil if no plugin executable is found for it.
+func (r *Registry) plugin(name string) *provider {
+	if name == "" || reservedName(name) {
+		return nil
+	}
+	for _, c := range name {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-' || c == '_') {
+			return nil
+		}
+	}
+	r.mu.Lock()
+	dirs := r.pluginPath
+	r.mu.Unlock()
+	if dirs == nil {
+		dirs = filepath.SplitList(os.Getenv("INFRA_PLUGIN_PATH"))
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, PluginPrefix+name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			log.Debug.Printf("infra: using plugin %s for provider %s", path, name)
+			return &provider{name: name, typ: typeOfPluginPtr, plugin: path}
+		}
+	}
+	return nil
+}
+
+// PluginRequest is a request from package infra to a plugin.
+type PluginRequest struct {
+	// Method is the requested method: one of PluginHelp,
+	// PluginConfig, PluginVersion, PluginInit, PluginSetup, or
+	// PluginTeardown.
+	Method string `json:"method"`
+	// Name is the name of the provider served by the plugin.
+	Name string `json:"name"`
+	// Config is the provider's current configuration. It is set for
+	// PluginInit, PluginSetup, and PluginTeardown requests.
+	Config map[string]interface{} `json:"config,omitempty"`
+	// Flags are the values of the provider's flags, as declared in
+	// the plugin's response to PluginHelp. It is set for PluginInit,
+	// PluginSetup, and PluginTeardown requests.
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// PluginFlag describes a flag of a plugin provider.
+type PluginFlag struct {
+	Name    string `json:"name"`
+	Usage   string `json:"usage"`
+	Default string `json:"default,omitempty"`
+}
+
+// PluginResponse is a plugin's response to a PluginRequest.
+type PluginResponse struct {
+	// Error is the error message of a failed request.
+	Error string `json:"error,omitempty"`
+	// Help is the provider's help text, in response to PluginHelp.
+	Help string `json:"help,omitempty"`
+	// Flags are the provider's flags, in response to PluginHelp.
+	Flags []PluginFlag `json:"flags,omitempty"`
+	// Version is the provider's version, in response to
+	// PluginVersion.
+	Version int `json:"version,omitempty"`
+	// Config is the provider's default configuration, in response
+	// to PluginConfig, or its updated configuration, in response to
+	// PluginInit, PluginSetup, and PluginTeardown. A nil
+	// configuration leaves the configuration unchanged.
+	Config map[string]interface{} `json:"config,omitempty"`
+	// Value is the value provided by the plugin, in response to
+	// PluginInit. See Plugin.Value.
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ServePlugin serves a single plugin request: it reads a
+// JSON-encoded PluginRequest from r, and writes the JSON-encoded
+// PluginResponse returned by handle to w. Errors returned by handle
+// are reported to the requester. ServePlugin is meant to be called
+// by the main function of a plugin executable with os.Stdin and
+// os.Stdout.
+//
+// Each plugin request is made by a separate invocation of the
+// plugin executable, which therefore should not keep state between
+// requests, other than in the provider's configuration.
+func ServePlugin(r io.Reader, w io.Writer, handle func(*PluginRequest) (*PluginResponse, error)) error {
+	var req PluginRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return err
+	}
+	resp, err := handle(&req)
+	if err != nil {
+		resp = &PluginResponse{Error: err.Error()}
+	} else if resp == nil {
+		resp = new(PluginResponse)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// Plugin is the value of plugin providers: providers that are not
+// linked into the binary, but instead are served by external
+// executables (see Registry.SetPluginPath and ServePlugin). A schema
+// key that is bound to *Plugin may be configured with any plugin
+// provider. The plugin's Init, Setup, Teardown, Config, Version, and
+// Help methods are forwarded to the plugin executable, and the plugin's
+// flags are declared as string flags.
+type Plugin struct {
+	name, path string
+
+	mu     sync.Mutex
+	config map[string]interface{}
+	value  interface{}
+	flags  map[string]*string
+
+	helpOnce, configOnce, versionOnce sync.Once
+	help                              *PluginResponse
+	version                           int
+	err                               error
+}
+
+// Name returns the name of the plugin provider.
+func (p *Plugin) Name() string { return p.name }
+
+// Value unmarshals the value provided by the plugin's Init method
+// into the value pointed to by ptr, as by encoding/json.
+func (p *Plugin) Value(ptr interface{}) error {
+	p.mu.Lock()
+	value := p.value
+	p.mu.Unlock()
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, ptr)
+}
+
+// Init initializes the plugin provider.
+func (p *Plugin) Init() error {
+	resp, err := p.request(PluginInit)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.value = resp.Value
+	p.mu.Unlock()
+	return nil
+}
+
+// Setup performs the plugin provider's setup.
+func (p *Plugin) Setup() error {
+	_, err := p.request(PluginSetup)
+	return err
+}
+
+// Teardown removes the infrastructure set up by the plugin provider.
+func (p *Plugin) Teardown() error {
+	_, err := p.request(PluginTeardown)
+	return err
+}
+
+// Config returns the plugin provider's configuration, which
+// defaults to the configuration returned by the plugin.
+func (p *Plugin) Config() interface{} {
+	p.configOnce.Do(func() {
+		resp, err := p.call(&PluginRequest{Method: PluginConfig})
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.mu.Lock()
+		if p.config == nil {
+			p.config = resp.Config
+		}
+		p.mu.Unlock()
+	})
+	return &pluginConfig{p}
+}
+
+// pluginConfig is the configuration of a plugin provider, as
+// returned by Plugin.Config. The plugin updates its configuration
+// in response to requests, so the configuration is marshaled and
+// unmarshaled while holding the plugin's lock.
+type pluginConfig struct{ p *Plugin }
+
+// MarshalYAML implements yaml.Marshaler.
+func (c *pluginConfig) MarshalYAML() (interface{}, error) {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	return deepcopy(c.p.config), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (c *pluginConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var config map[string]interface{}
+	if err := unmarshal(&config); err != nil {
+		return err
+	}
+	c.p.mu.Lock()
+	c.p.config = config
+	c.p.mu.Unlock()
+	return nil
+}
+
+// Version returns the plugin provider's version.
+func (p *Plugin) Version() int {
+	p.versionOnce.Do(func() {
+		resp, err := p.call(&PluginRequest{Method: PluginVersion})
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.version = resp.Version
+	})
+	return p.version
+}
+
+// Help returns the plugin provider's help text.
+func (p *Plugin) Help() string {
+	return p.describe().Help
+}
+
+// Flags declares the plugin provider's flags.
+func (p *Plugin) Flags(flags *flag.FlagSet) {
+	declared := make(map[string]*string)
+	for _, f := range p.describe().Flags {
+		declared[f.Name] = flags.String(f.Name, f.Default, f.Usage)
+	}
+	p.mu.Lock()
+	p.flags = declared
+	p.mu.Unlock()
+}
+
+// describe returns the plugin's response to PluginHelp.
+func (p *Plugin) describe() *PluginResponse {
+	p.helpOnce.Do(func() {
+		var err error
+		if p.help, err = p.call(&PluginRequest{Method: PluginHelp}); err != nil {
+			p.fail(err)
+			p.help = new(PluginResponse)
+		}
+	})
+	return p.help
+}
+
+// fail records an error from a plugin method that cannot return
+// errors; it is returned by subsequent requests, so that a plugin
+// whose help, configuration, or version is unavailable is never
+// initialized, set up, or torn down.
+func (p *Plugin) fail(err error) {
+	log.Error.Print(err)
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+}
+
+// request makes a request for the provided method with the plugin
+// provider's current configuration and flags, and updates the
+// configuration with the one returned by the plugin.
+func (p *Plugin) request(method string) (*PluginResponse, error) {
+	p.describe()
+	p.Config()
+	p.Version()
+	req := &PluginRequest{Method: method, Flags: make(map[string]string)}
+	p.mu.Lock()
+	err := p.err
+	for name, val := range p.flags {
+		req.Flags[name] = *val
+	}
+	if p.config != nil {
+		req.Config = jsonable(p.config).(map[string]interface{})
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.call(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Config != nil {
+		p.mu.Lock()
+		p.config = resp.Config
+		p.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// call makes the provided request by invoking the plugin executable.
+func (p *Plugin) call(req *PluginRequest) (*PluginResponse, error) {
+	if p.path == "" {
+		return nil, fmt.Errorf("plugin %s: no plugin executable", p.name)
+	}
+	req.Name = p.name
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %s: %v", p.name, req.Method, err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(p.path)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("plugin %s: %s: %v", p.name, req.Method, err)
+	}
+	var resp PluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s: %s: malformed response: %v", p.name, req.Method, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin %s: %s: %s", p.name, req.Method, resp.Error)
+	}
+	return &resp, nil
+}
+
+// jsonable returns a copy of the YAML-decoded value v in which maps
+// are keyed by strings, so that it may be encoded as JSON.
+func jsonable(v interface{}) interface{} {
+	switch w := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(w))
+		for k, v := range w {
+			m[fmt.Sprint(k)] = jsonable(v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(w))
+		for k, v := range w {
+			m[k] = jsonable(v)
+		}
+		return m
+	case Keys:
+		return jsonable(map[string]interface{}(w))
+	case []interface{}:
+		s := make([]interface{}, len(w))
+		for i, v := range w {
+			s[i] = jsonable(v)
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/testutil"
+)
+
+// TestMain serves the test plugin when the test binary is invoked as
+// a plugin executable.
+func TestMain(m *testing.M) {
+	if os.Getenv("INFRA_TEST_PLUGIN") != "" {
+		if err := infra.ServePlugin(os.Stdin, os.Stdout, serveTestPlugin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// serveTestPlugin implements the test plugin testdns, which
+// manages a DNS zone, and testbrokendns, which fails to report its
+// version.
+func serveTestPlugin(req *infra.PluginRequest) (*infra.PluginResponse, error) {
+	if req.Name == "testbrokendns" && req.Method == infra.PluginVersion {
+		return nil, errors.New("version unavailable")
+	}
+	switch req.Method {
+	case infra.PluginHelp:
+		return &infra.PluginResponse{
+			Help: "testdns manages a DNS zone",
+			Flags: []infra.PluginFlag{
+				{Name: "zone", Usage: "DNS zone", Default: "example.com"},
+				{Name: "fail", Usage: "fail initialization", Default: "false"},
+			},
+		}, nil
+	case infra.PluginConfig:
+		return &infra.PluginResponse{Config: map[string]interface{}{"ttl": 60}}, nil
+	case infra.PluginVersion:
+		return &infra.PluginResponse{Version: 2}, nil
+	case infra.PluginInit:
+		if req.Flags["fail"] == "true" {
+			return nil, errors.New("zone unavailable")
+		}
+		req.Config["zone"] = req.Flags["zone"]
+		return &infra.PluginResponse{
+			Config: req.Config,
+			Value:  map[string]interface{}{"zone": req.Flags["zone"], "ttl": req.Config["ttl"]},
+		}, nil
+	case infra.PluginSetup:
+		req.Config["record"] = "created-" + req.Flags["zone"]
+		return &infra.PluginResponse{Config: req.Config}, nil
+	case infra.PluginTeardown:
+		delete(req.Config, "record")
+		return &infra.PluginResponse{Config: req.Config}, nil
+	}
+	return nil, fmt.Errorf("unknown method %s", req.Method)
+}
+
+func TestPlugin(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	if err := os.Symlink(exe, filepath.Join(dir, infra.PluginPrefix+"testdns")); err != nil {
+		t.Fatal(err)
+	}
+	defer setenv(t, "INFRA_TEST_PLUGIN", "1")()
+	reg := infra.NewRegistry()
+	reg.SetPluginPath(dir)
+
+	schema := infra.Schema{"dns": new(infra.Plugin)}
+	config, err := schema.MakeWithRegistry(reg, infra.Keys{"dns": "testdns,zone=grail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The plugin's configuration may be marshaled while the plugin
+	// updates it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, err := config.Marshal(false); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	var plugin *infra.Plugin
+	config.Must(&plugin)
+	<-done
+	if got, want := plugin.Name(), "testdns"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := plugin.Help(), "testdns manages a DNS zone"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var value struct {
+		Zone string
+		TTL  int
+	}
+	if err := plugin.Value(&value); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := value.Zone, "grail.com"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := value.TTL, 60; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"testdns:\n  record: created-grail.com\n  ttl: 60\n  zone: grail.com\n",
+		"  testdns: 2\n",
+	} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("marshaled config %s does not contain %q", p, want)
+		}
+	}
+
+	config, err = schema.MakeWithRegistry(reg, infra.Keys{"dns": "testdns,fail=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Instance(&plugin); err == nil || !strings.Contains(err.Error(), "plugin testdns: Init: zone unavailable") {
+		t.Errorf("got %v, want plugin error", err)
+	}
+	// Errors from methods that cannot return them are surfaced by
+	// Init.
+	if err := os.Symlink(exe, filepath.Join(dir, infra.PluginPrefix+"testbrokendns")); err != nil {
+		t.Fatal(err)
+	}
+	config, err = schema.MakeWithRegistry(reg, infra.Keys{"dns": "testbrokendns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Instance(&plugin); err == nil || !strings.Contains(err.Error(), "plugin testbrokendns: Version: version unavailable") {
+		t.Errorf("got %v, want version error", err)
+	}
+	if _, err := schema.MakeWithRegistry(reg, infra.Keys{"dns": "testdnsx"}); err == nil || !strings.Contains(err.Error(), infra.PluginPrefix+"testdnsx") {
+		t.Errorf("got %v, want missing plugin error", err)
+	}
+}
+
+func TestPluginPath(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	if err := os.Symlink(exe, filepath.Join(dir, infra.PluginPrefix+"testdns")); err != nil {
+		t.Fatal(err)
+	}
+	defer setenv(t, "INFRA_TEST_PLUGIN", "1")()
+	schema := infra.Schema{"dns": new(infra.Plugin)}
+	keys := infra.Keys{"dns": "testdns,zone=grail.com"}
+
+	// Plugins are not looked up in PATH.
+	defer setenv(t, "PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))()
+	defer setenv(t, "INFRA_PLUGIN_PATH", "")()
+	os.Unsetenv("INFRA_PLUGIN_PATH")
+	if _, err := schema.MakeWithRegistry(infra.NewRegistry(), keys); err == nil {
+		t.Error("expected error")
+	}
+	os.Setenv("INFRA_PLUGIN_PATH", dir)
+	if _, err := schema.MakeWithRegistry(infra.NewRegistry(), keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setenv sets the environment variable key to value, and returns a
+// function that restores its previous value.
+func setenv(t *testing.T, key, value string) func() {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
@@ -5,9 +5,11 @@
 package infra
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/grailbio/base/log"
@@ -15,22 +17,55 @@ import (
 )
 
 var (
-	typeOfError      = reflect.TypeOf((*error)(nil)).Elem()
-	typeOfInt        = reflect.TypeOf(int(0))
-	typeOfFlagSetPtr = reflect.TypeOf(new(flag.FlagSet))
+	typeOfError       = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfInt         = reflect.TypeOf(int(0))
+	typeOfBool        = reflect.TypeOf(false)
+	typeOfString      = reflect.TypeOf("")
+	typeOfStringSlice = reflect.TypeOf([]string(nil))
+	typeOfFlagSetPtr  = reflect.TypeOf(new(flag.FlagSet))
+	typeOfPromptSlice = reflect.TypeOf([]Prompt(nil))
 
 	reservedKeys = map[string]bool{
 		"versions":  true,
 		"instances": true,
+		"outputs":   true,
 		"infra":     true,
 	}
-
-	mu        sync.Mutex
-	providers = map[string]*provider{}
 )
 
-// Register registers a provider for the given key. Key name may only contain
-// characters a-z, 0-9, _ or -.
+// reservedName returns whether name may not be used as a provider
+// name: the reserved top-level keys hold package infra's metadata and
+// state, and firstof is the built-in fallback combinator.
+func reservedName(name string) bool {
+	return reservedKeys[name] || name == firstOfName
+}
+
+// DefaultRegistry is the registry used by Register, Schema.Make,
+// and Schema.Unmarshal.
+var DefaultRegistry = NewRegistry()
+
+// A Registry is a set of named providers. Configurations look up
+// the providers named by their keys in a registry. Independent
+// registries may register different providers under the same name.
+type Registry struct {
+	mu         sync.Mutex
+	providers  map[string]*provider
+	aliases    map[string]alias
+	decorators map[string]*provider
+	pluginPath []string
+}
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		providers:  make(map[string]*provider),
+		aliases:    make(map[string]alias),
+		decorators: make(map[string]*provider),
+	}
+}
+
+// Register registers a provider for the given key in DefaultRegistry.
+// Key name may only contain characters a-z, 0-9, _ or -.
 // Providers must be a "defined" type -- i.e., they must be named (they cannot be
 // struct{}, int, string, etc.).
 //
@@ -55,6 +90,24 @@ var (
 //	// value.
 //	Setup(req1 type1, req2 type2, ...) error
 //
+//	// Refresh compares the state recorded in the provider's
+//	// configuration and instance configuration with the current
+//	// state of the infrastructure it manages, using the given
+//	// requirements. Refresh returns whether the infrastructure has
+//	// drifted from its recorded state, along with a human-readable
+//	// description of the drift.
+//	Refresh(req1 type1, req2 type2, ...) (drifted bool, details string, err error)
+//
+//	// Import populates the provider's configuration and instance
+//	// configuration from the existing infrastructure resource
+//	// identified by id, using the given requirements. Import is used
+//	// to adopt infrastructure that was not created by Setup.
+//	Import(id string, req1 type1, req2 type2, ...) error
+//
+//	// Teardown removes the infrastructure set up by Setup, using
+//	// the given requirements. See Config.Teardown.
+//	Teardown(req1 type1, req2 type2, ...) error
+//
 //	// Version returns the provider's version. Managed infrastructure
 //	// is considered out of date if the currently configured version
 //	// is less than the returned version. (Configured versions start
@@ -72,16 +125,54 @@ var (
 //	// initialized by Init) so that it may be restored later.
 //	InstanceConfig() interface{}
 //
-//  // Help returns the help text for the provider.
-//  Help() string
+//	// Outputs returns the provider's outputs: values computed by the
+//	// provider, typically during Setup, that are needed by other
+//	// providers or by callers. Outputs are marshaled with the
+//	// configuration, and must be a pointer to a defined type, which
+//	// must not be shared with any other provider's outputs. Other
+//	// providers may require this type in their Init, Setup, Refresh,
+//	// or Import methods, in which case the outputs are provided
+//	// without initializing the provider that produced them.
+//	Outputs() interface{}
+//
+//	// Help returns the help text for the provider.
+//	Help() string
+//
+//	// Sensitive returns the dot-separated YAML paths of sensitive
+//	// values in the provider's configuration, instance
+//	// configuration, and outputs. Sensitive values are masked by
+//	// Config.MarshalRedacted. An empty path denotes the whole
+//	// configuration.
+//	Sensitive() []string
+//
+//	// Eager returns whether the provider should be initialized
+//	// eagerly, when the configuration is made, instead of when its
+//	// value is first requested. See Config.InitAll.
+//	Eager() bool
+//
+//	// Prompts returns the prompts used to ask for the provider's
+//	// flags and configuration fields by Schema.Interactive.
+//	Prompts() []Prompt
+//
+// Of these, methods Refresh, Import, Teardown, Outputs, Sensitive,
+// Eager, and Prompts are optional hooks: a method named like a hook
+// whose signature does not match is not treated as the hook.
 func Register(name string, iface interface{}) {
-	for _, r := range name {
-		if '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || r == '-' || r == '_' {
+	DefaultRegistry.Register(name, iface)
+}
+
+// Register registers a provider with the given name in the registry
+// r, as documented in the package-level Register. Register panics
+// if the name is invalid or already registered in r, or if the
+// provider's methods are not well-typed.
+func (r *Registry) Register(name string, iface interface{}) {
+	for _, c := range name {
+		if '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-' || c == '_' {
 			continue
 		}
 		log.Panicf("infra.Register: invalid name %s: identifiers may only contain 0-9, a-z, -, or _", name)
 	}
-	if reservedKeys[name] {
+	if reservedName(name) {
 		panic("infra.Register: key " + name + " is reserved")
 	}
 	typ := reflect.TypeOf(iface)
@@ -89,31 +180,65 @@ func Register(name string, iface interface{}) {
 	if err := p.Typecheck(); err != nil {
 		panic("infra.Register: invalid type " + p.typ.String() + " for provider named " + name + ": " + err.Error())
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	if providers[name] != nil {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.providers[name] != nil {
 		panic("infra.Register: provider named " + name + " is already registered")
 	}
+	if _, ok := r.aliases[name]; ok {
+		panic("infra.Register: " + name + " is already registered as an alias")
+	}
+	if r.decorators[name] != nil {
+		panic("infra.Register: " + name + " is already registered as a decorator")
+	}
 	log.Debug.Printf("infra.Register: registered provider named %s", name)
 
-	providers[name] = p
+	r.providers[name] = p
+}
+
+// Lookup returns the type of the provider registered with the given
+// name in the registry r, and whether such a provider is registered.
+func (r *Registry) Lookup(name string) (reflect.Type, bool) {
+	p := r.lookup(name)
+	if p == nil {
+		return nil, false
+	}
+	return p.Type(), true
 }
 
 type provider struct {
 	name string
 	typ  reflect.Type
+	// plugin is the path of the plugin executable that serves the
+	// provider, if it is a plugin provider.
+	plugin string
 }
 
-func lookup(key string) *provider {
-	mu.Lock()
-	p := providers[key]
-	mu.Unlock()
+func (r *Registry) lookup(key string) *provider {
+	r.mu.Lock()
+	p := r.providers[key]
+	r.mu.Unlock()
 	return p
 }
 
+// registered returns the providers currently registered in r,
+// ordered by name.
+func (r *Registry) registered() []*provider {
+	r.mu.Lock()
+	ps := make([]*provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		ps = append(ps, p)
+	}
+	r.mu.Unlock()
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+	return ps
+}
+
 // Typecheck performs typechecking of the provider. Specifically,
 // methods Init, Setup, and Version must match their expected
-// signatures as documented in Register.
+// signatures as documented in Register. Optional hooks (see
+// hookSignatures) are not checked: methods that do not match a
+// hook's signature are not treated as hooks.
 func (p *provider) Typecheck() error {
 	if m, ok := p.typ.MethodByName("Init"); ok {
 		typ := m.Type
@@ -144,6 +269,35 @@ func (p *provider) Typecheck() error {
 	return nil
 }
 
+// hookSignatures maps the names of the optional provider hooks
+// documented in Register to predicates that match their method
+// types (including the receiver). A provider may have methods with
+// these names for other purposes: they are hooks only if their
+// signatures match.
+var hookSignatures = map[string]func(reflect.Type) bool{
+	"Refresh": func(typ reflect.Type) bool {
+		return typ.NumOut() == 3 && typ.Out(0) == typeOfBool && typ.Out(1) == typeOfString && typ.Out(2) == typeOfError
+	},
+	"Import": func(typ reflect.Type) bool {
+		return typ.NumIn() >= 2 && typ.In(1) == typeOfString && typ.NumOut() == 1 && typ.Out(0) == typeOfError
+	},
+	"Teardown": func(typ reflect.Type) bool {
+		return typ.NumOut() == 1 && typ.Out(0) == typeOfError
+	},
+	"Sensitive": func(typ reflect.Type) bool {
+		return typ.NumIn() == 1 && typ.NumOut() == 1 && typ.Out(0) == typeOfStringSlice
+	},
+	"Eager": func(typ reflect.Type) bool {
+		return typ.NumIn() == 1 && typ.NumOut() == 1 && typ.Out(0) == typeOfBool
+	},
+	"Prompts": func(typ reflect.Type) bool {
+		return typ.NumIn() == 1 && typ.NumOut() == 1 && typ.Out(0) == typeOfPromptSlice
+	},
+	"Outputs": func(typ reflect.Type) bool {
+		return typ.NumIn() == 1 && typ.NumOut() == 1
+	},
+}
+
 // Type returns the type of values managed by this provider.
 func (p *provider) Type() reflect.Type {
 	return p.typ
@@ -158,19 +312,39 @@ type instance struct {
 
 	config   Config
 	name     string
-	initOnce once.Task
 	flags    flag.FlagSet
 	flagOnce sync.Once
+
+	// inner is the instance decorated by this instance, if it is a
+	// decorator.
+	inner *instance
+	// candidates are the candidate instances of a firstof instance;
+	// chosen is the candidate that it binds. Candidate instances
+	// have candidate set.
+	candidates []*instance
+	chosen     *instance
+	candidate  bool
+
+	// mu protects initOnce, initErr, and initDone, so that a failed
+	// initialization may be reset.
+	mu       sync.Mutex
+	initOnce *once.Task
+	initErr  error
+	initDone bool
 }
 
 // New returns a new instance for the given Config.
 func (p *provider) New(c Config, field string) *instance {
-	inst := &instance{typ: p.typ, name: p.name, config: c, field: field}
+	inst := &instance{typ: p.typ, name: p.name, config: c, field: field, initOnce: new(once.Task)}
 	if p.typ.Kind() == reflect.Ptr {
 		inst.val = reflect.New(p.typ.Elem())
 	} else {
 		inst.val = reflect.Zero(p.typ)
 	}
+	if p.plugin != "" {
+		plugin := inst.val.Interface().(*Plugin)
+		plugin.name, plugin.path = p.name, p.plugin
+	}
 	return inst
 }
 
@@ -181,6 +355,9 @@ func (inst *instance) Impl() string { return inst.name }
 // Value returns the value managed by this provider
 // instance.
 func (inst *instance) Value() reflect.Value {
+	if chosen := inst.selected(); chosen != nil {
+		return chosen.Value()
+	}
 	if inst.field != "" {
 		val := inst.val
 		for val.Kind() == reflect.Ptr {
@@ -195,60 +372,240 @@ func (inst *instance) Value() reflect.Value {
 // instance's configuration to look up dependent values; thus the
 // dependency graph between instances must be well formed.
 func (inst *instance) Init() error {
-	if _, ok := inst.typ.MethodByName("Init"); !ok {
+	return inst.InitContext(context.Background())
+}
+
+// InitContext performs value initialization as in Init. Retries of
+// failed initializations, of the instance and of its requirements,
+// stop when the provided context is done.
+func (inst *instance) InitContext(ctx context.Context) error {
+	if _, ok := inst.typ.MethodByName("Init"); !ok && inst.candidates == nil {
 		return nil
 	}
-	init := inst.val.MethodByName("Init")
-	return inst.initOnce.Do(func() error {
-		types := inst.RequiresInit()
-		args := make([]reflect.Value, len(types))
-		for i, typ := range types {
-			atyp, err := assignUnique(typ, inst.config.typeset)
-			if err != nil {
-				panic(err)
-			}
-			arg := inst.config.instances[atyp]
-			if err := arg.Init(); err != nil {
-				return err
-			}
-			args[i] = inst.config.getValue(arg, typ)
+	inst.mu.Lock()
+	task := inst.initOnce
+	inst.mu.Unlock()
+	return task.Do(func() error {
+		var err error
+		if inst.candidates != nil {
+			err = inst.choose(ctx)
+		} else {
+			err = inst.init(ctx)
 		}
-		err := init.Call(args)[0].Interface()
+		inst.mu.Lock()
+		inst.initErr = err
+		inst.initDone = err == nil
+		inst.mu.Unlock()
+		return err
+	})
+}
+
+// Initialized returns whether the instance has been successfully
+// initialized. Instances of providers without Init methods are
+// always initialized.
+func (inst *instance) Initialized() bool {
+	if _, ok := inst.typ.MethodByName("Init"); !ok && inst.candidates == nil {
+		return true
+	}
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.initDone
+}
+
+// init calls the instance's Init method with its requirements.
+func (inst *instance) init(ctx context.Context) error {
+	args, err := inst.args(ctx, inst.RequiresInit())
+	if err != nil {
+		return err
+	}
+	if inst.inner != nil {
+		inner, err := inst.innerValue(ctx)
 		if err != nil {
-			return err.(error)
+			return err
 		}
-		return nil
+		args = append([]reflect.Value{inner}, args...)
+	}
+	init := inst.val.MethodByName("Init")
+	return inst.observed(Event{}, Observer.OnInitStart, Observer.OnInitEnd, func() error {
+		return inst.retry(ctx, "Init", func() error {
+			if err := init.Call(args)[0].Interface(); err != nil {
+				return err.(error)
+			}
+			return nil
+		})
 	})
 }
 
+// Failed returns whether the instance's initialization failed.
+func (inst *instance) Failed() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.initErr != nil
+}
+
+// Reset resets the instance's failed initialization, so that it is
+// attempted again by the next call to Init. Reset is a no-op if the
+// instance's initialization has not failed.
+func (inst *instance) Reset() {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.initErr != nil {
+		inst.initOnce = new(once.Task)
+		inst.initErr = nil
+	}
+}
+
+// HasSetup returns whether this instance's provider implements
+// Setup.
+func (inst *instance) HasSetup() bool {
+	for _, cand := range inst.candidates {
+		if cand.HasSetup() {
+			return true
+		}
+	}
+	_, ok := inst.typ.MethodByName("Setup")
+	return ok
+}
+
 // Setup performs provider setup for the instance. Setup
 // uses the configuration to instantiate required values;
 // thus the instance dependency graph must be well formed.
 func (inst *instance) Setup() error {
-	if _, ok := inst.typ.MethodByName("Setup"); !ok {
+	if !inst.HasSetup() {
+		return nil
+	}
+	if inst.candidates != nil {
+		return inst.setupChosen()
+	}
+	args, err := inst.args(context.Background(), inst.RequiresSetup())
+	if err != nil {
+		return err
+	}
+	ev := Event{FromVersion: -1, ToVersion: inst.Version()}
+	if version, ok := inst.config.versions[inst.Impl()]; ok {
+		ev.FromVersion = version
+	}
+	return inst.observed(ev, Observer.OnSetupStart, Observer.OnSetupEnd, func() error {
+		return inst.retry(context.Background(), "Setup", func() error {
+			if err := inst.val.MethodByName("Setup").Call(args)[0].Interface(); err != nil {
+				return err.(error)
+			}
+			return nil
+		})
+	})
+}
+
+// HasRefresh returns whether this instance's provider implements
+// drift detection.
+func (inst *instance) HasRefresh() bool {
+	return inst.hook("Refresh")
+}
+
+// Refresh compares the instance's recorded state with the state of
+// the infrastructure it manages. Like Setup, Refresh uses the
+// configuration to instantiate required values.
+func (inst *instance) Refresh() (drifted bool, details string, err error) {
+	if !inst.HasRefresh() {
+		return false, "", nil
+	}
+	args, err := inst.args(context.Background(), inst.RequiresRefresh())
+	if err != nil {
+		return false, "", err
+	}
+	out := inst.val.MethodByName("Refresh").Call(args)
+	if err := out[2].Interface(); err != nil {
+		return false, "", err.(error)
+	}
+	return out[0].Bool(), out[1].String(), nil
+}
+
+// HasTeardown returns whether this instance's provider implements
+// Teardown.
+func (inst *instance) HasTeardown() bool {
+	return inst.hook("Teardown")
+}
+
+// Teardown removes the infrastructure managed by the instance. Like
+// Setup, Teardown uses the configuration to instantiate required
+// values.
+func (inst *instance) Teardown() error {
+	if !inst.HasTeardown() {
 		return nil
 	}
-	var (
-		setup = inst.val.MethodByName("Setup")
-		types = inst.RequiresSetup()
-		args  = make([]reflect.Value, len(types))
-	)
+	args, err := inst.args(context.Background(), inst.RequiresTeardown())
+	if err != nil {
+		return err
+	}
+	if err := inst.val.MethodByName("Teardown").Call(args)[0].Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// HasImport returns whether this instance's provider supports
+// importing existing infrastructure.
+func (inst *instance) HasImport() bool {
+	return inst.hook("Import")
+}
+
+// Import imports the infrastructure resource with the provided
+// identifier into the instance's configuration. Like Setup, Import
+// uses the configuration to instantiate required values.
+func (inst *instance) Import(id string) error {
+	if !inst.HasImport() {
+		return fmt.Errorf("provider %s does not support import", inst.Impl())
+	}
+	args, err := inst.args(context.Background(), inst.RequiresImport())
+	if err != nil {
+		return err
+	}
+	args = append([]reflect.Value{reflect.ValueOf(id)}, args...)
+	if err := inst.val.MethodByName("Import").Call(args)[0].Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// args initializes and returns the values of the provided types,
+// as managed by the instance's configuration. Provider outputs are
+// returned without initializing their producers. Values are
+// initialized with the provided context; see InitContext.
+func (inst *instance) args(ctx context.Context, types []reflect.Type) ([]reflect.Value, error) {
+	args := make([]reflect.Value, len(types))
 	for i, typ := range types {
+		if producer := inst.config.outputs[typ]; producer != nil {
+			args[i] = reflect.ValueOf(producer.Outputs())
+			continue
+		}
 		atyp, err := assignUnique(typ, inst.config.typeset)
 		if err != nil {
 			panic(err)
 		}
 		arg := inst.config.instances[atyp]
-		if err := arg.Init(); err != nil {
-			return err
+		if err := arg.InitContext(ctx); err != nil {
+			return nil, err
 		}
 		args[i] = inst.config.getValue(arg, typ)
 	}
-	err := setup.Call(args)[0].Interface()
-	if err != nil {
-		return err.(error)
+	return args, nil
+}
+
+// prepare initializes the values required by one of the instance's
+// methods, as returned by requires (e.g., (*instance).RequiresSetup),
+// so that the method may then be called while holding the config's
+// lock: prepare is called without the lock, so that the required
+// providers' Init methods may use the config. The requirements of a
+// firstof instance are those of its chosen candidate, which is
+// chosen first.
+func (inst *instance) prepare(requires func(*instance) []reflect.Type) error {
+	if inst.candidates != nil {
+		if err := inst.Init(); err != nil {
+			return err
+		}
+		return inst.selected().prepare(requires)
 	}
-	return nil
+	_, err := inst.args(context.Background(), requires(inst))
+	return err
 }
 
 // Config returns the instance's config.
@@ -260,6 +617,14 @@ func (inst *instance) Config() interface{} {
 	return config.Call(nil)[0].Interface()
 }
 
+// Outputs returns the instance's outputs.
+func (inst *instance) Outputs() interface{} {
+	if !inst.hook("Outputs") {
+		return nil
+	}
+	return inst.val.MethodByName("Outputs").Call(nil)[0].Interface()
+}
+
 // HasInstanceConfig returns whether this instance provides an
 // instance configuration.
 func (inst *instance) HasInstanceConfig() bool {
@@ -299,6 +664,9 @@ func (inst *instance) Flags() *flag.FlagSet {
 
 // Version returns the provider version for this instance.
 func (inst *instance) Version() int {
+	if inst.candidates != nil {
+		return inst.candidateVersion()
+	}
 	if _, ok := inst.typ.MethodByName("Version"); !ok {
 		return 0
 	}
@@ -313,16 +681,38 @@ func (inst *instance) Help() string {
 	return inst.val.MethodByName("Help").Call(nil)[0].Interface().(string)
 }
 
-// RequiresInit returns the set of types required by this instance's
-// Init method.
-func (inst *instance) RequiresInit() []reflect.Type {
-	m, ok := inst.typ.MethodByName("Init")
-	if !ok {
+// Sensitive returns the YAML paths of the sensitive values in this
+// instance's configurations, as declared by the provider.
+func (inst *instance) Sensitive() []string {
+	if !inst.hook("Sensitive") {
 		return nil
 	}
-	types := make([]reflect.Type, m.Type.NumIn()-1)
-	for i := range types {
-		types[i] = m.Type.In(i + 1)
+	return inst.val.MethodByName("Sensitive").Call(nil)[0].Interface().([]string)
+}
+
+// Eager returns whether the instance should be initialized eagerly.
+func (inst *instance) Eager() bool {
+	if !inst.hook("Eager") {
+		return false
+	}
+	return inst.val.MethodByName("Eager").Call(nil)[0].Bool()
+}
+
+// Prompts returns the prompts declared by the instance's provider.
+func (inst *instance) Prompts() []Prompt {
+	if !inst.hook("Prompts") {
+		return nil
+	}
+	return inst.val.MethodByName("Prompts").Call(nil)[0].Interface().([]Prompt)
+}
+
+// RequiresInit returns the set of types required by this instance's
+// Init method. The decorated value, which is the first argument to
+// a decorator's Init method, is not included.
+func (inst *instance) RequiresInit() []reflect.Type {
+	types := inst.requires("Init")
+	if inst.inner != nil {
+		types = types[1:]
 	}
 	return types
 }
@@ -330,10 +720,41 @@ func (inst *instance) RequiresInit() []reflect.Type {
 // RequiresSetup returns the set of types required by this instance's
 // Setup method.
 func (inst *instance) RequiresSetup() []reflect.Type {
-	m, ok := inst.typ.MethodByName("Setup")
+	return inst.requires("Setup")
+}
+
+// RequiresRefresh returns the set of types required by this
+// instance's Refresh method.
+func (inst *instance) RequiresRefresh() []reflect.Type {
+	return inst.requires("Refresh")
+}
+
+// RequiresTeardown returns the set of types required by this
+// instance's Teardown method.
+func (inst *instance) RequiresTeardown() []reflect.Type {
+	return inst.requires("Teardown")
+}
+
+// RequiresImport returns the set of types required by this
+// instance's Import method, following the resource identifier.
+func (inst *instance) RequiresImport() []reflect.Type {
+	types := inst.requires("Import")
+	if len(types) == 0 {
+		return nil
+	}
+	return types[1:]
+}
+
+// requires returns the set of types required by this instance's
+// method with the provided name.
+func (inst *instance) requires(name string) []reflect.Type {
+	m, ok := inst.typ.MethodByName(name)
 	if !ok {
 		return nil
 	}
+	if _, ok := hookSignatures[name]; ok && !inst.hook(name) {
+		return nil
+	}
 	types := make([]reflect.Type, m.Type.NumIn()-1)
 	for i := range types {
 		types[i] = m.Type.In(i + 1)
@@ -341,6 +762,13 @@ func (inst *instance) RequiresSetup() []reflect.Type {
 	return types
 }
 
+// hook returns whether the instance's provider implements the
+// optional hook with the provided name, with a matching signature.
+func (inst *instance) hook(name string) bool {
+	m, ok := inst.typ.MethodByName(name)
+	return ok && hookSignatures[name](m.Type)
+}
+
 // CanMarshal returns whether the instance can be marshaled.
 func (inst *instance) CanMarshal() bool {
 	_, ok := inst.typ.MethodByName("MarshaledInstance")
@@ -12,7 +12,7 @@ func TestProvider(t *testing.T) {
 	type x int
 
 	typ := reflect.TypeOf(x(0))
-	p := provider{"", typ}
+	p := provider{name: "", typ: typ}
 	if err := p.Typecheck(); err != nil {
 		t.Fatal(err)
 	}
@@ -25,7 +25,7 @@ func TestProvider(t *testing.T) {
 	}
 
 	typ = reflect.TypeOf(new(x))
-	p = provider{"", typ}
+	p = provider{name: "", typ: typ}
 	if err := p.Typecheck(); err != nil {
 		t.Fatal(err)
 	}
@@ -65,3 +65,45 @@ func TestProviderInvalidNameCaps(t *testing.T) {
 	}()
 	Register("CAPS", new(Schema))
 }
+
+// unhooked has methods named like optional hooks, but with other
+// signatures.
+type unhooked struct{}
+
+func (*unhooked) Prompts(string) []Prompt  { return nil }
+func (*unhooked) Refresh() error           { return nil }
+func (*unhooked) Import(int, string) error { return nil }
+func (*unhooked) Teardown() bool           { return false }
+func (*unhooked) Sensitive() string        { return "" }
+func (*unhooked) Eager(int) bool           { return true }
+func (*unhooked) Outputs(int) int          { return 0 }
+
+func TestProviderHookSignatures(t *testing.T) {
+	p := provider{name: "unhooked", typ: reflect.TypeOf(new(unhooked))}
+	if err := p.Typecheck(); err != nil {
+		t.Fatal(err)
+	}
+	inst := p.New(Config{}, "")
+	if inst.HasRefresh() || inst.HasImport() || inst.HasTeardown() {
+		t.Error("methods with other signatures treated as hooks")
+	}
+	if inst.Prompts() != nil || inst.Sensitive() != nil || inst.Eager() || inst.Outputs() != nil {
+		t.Error("methods with other signatures treated as hooks")
+	}
+	if got := inst.RequiresImport(); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestProviderReservedNames(t *testing.T) {
+	for _, name := range []string{"versions", "outputs", "infra", "firstof"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			NewRegistry().Register(name, new(Schema))
+		}()
+	}
+}
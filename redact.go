@@ -0,0 +1,110 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redacted replaces sensitive values in redacted configurations.
+const redacted = "<redacted>"
+
+// MarshalRedacted marshals the configuration using YAML, as in
+// Marshal(true), but with sensitive values masked, so that the
+// configuration is safe to log. Sensitive values are values of type
+// Secret, fields tagged `infra:"secret"` or `infra:"sensitive"`, and
+// the paths returned by a provider's Sensitive method. These are
+// masked in provider configurations, instance configurations, and
+// outputs. As in Marshal, values that were interpolated from
+// references are marshaled with their references, so that, for
+// example, values taken from the environment are not revealed.
+//
+// Unlike Marshal, MarshalRedacted does not initialize instances:
+// only the instance configurations of already-initialized instances
+// are included.
+func (c Config) MarshalRedacted() ([]byte, error) {
+	defer c.lock()()
+	keys := c.Keys.Clone()
+	keys["versions"] = c.versions
+	// Restoring references replaces typed configurations with their
+	// YAML trees, so the types, which determine the tagged sensitive
+	// values, are recorded first.
+	types := make(map[string]reflect.Type)
+	for _, inst := range c.allInstances() {
+		if v, ok := keys[inst.Impl()]; ok {
+			types[inst.Impl()] = reflect.TypeOf(v)
+		}
+	}
+	if err := restore(keys, c.refs); err != nil {
+		return nil, err
+	}
+	instanceConfigs, _ := keys["instances"].(Keys)
+	redactedConfigs := make(Keys)
+	outputs, _ := keys["outputs"].(Keys)
+	for _, inst := range c.allInstances() {
+		impl := inst.Impl()
+		if v, ok := keys[impl]; ok {
+			var err error
+			if keys[impl], err = redact(v, types[impl], inst.Sensitive()); err != nil {
+				return nil, fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+		if v, ok := instanceConfigs[impl]; ok && inst.Initialized() {
+			var err error
+			if redactedConfigs[impl], err = redact(v, reflect.TypeOf(v), inst.Sensitive()); err != nil {
+				return nil, fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+		if v, ok := outputs[impl]; ok {
+			var err error
+			if outputs[impl], err = redact(v, reflect.TypeOf(v), inst.Sensitive()); err != nil {
+				return nil, fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+	}
+	if len(redactedConfigs) > 0 {
+		keys["instances"] = redactedConfigs
+	} else {
+		delete(keys, "instances")
+	}
+	c.setMeta(keys)
+	return yaml.Marshal(keys)
+}
+
+// redact returns the YAML tree of v with its sensitive values
+// masked. Sensitive values are determined by the type typ, of which
+// v is a value or a YAML tree, as well as the provided dot-separated
+// paths.
+func redact(v interface{}, typ reflect.Type, sensitive []string) (interface{}, error) {
+	paths := taggedPaths(typ, []string{"secret", "sensitive"}, nil)
+	for _, path := range sensitive {
+		if path == "" {
+			paths = append(paths, nil)
+		} else {
+			paths = append(paths, strings.Split(path, "."))
+		}
+	}
+	if len(paths) == 0 {
+		return v, nil
+	}
+	var tree interface{}
+	if err := remarshal(v, &tree); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		var err error
+		tree, err = rewrite(tree, path, func(interface{}) (interface{}, error) {
+			return redacted, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
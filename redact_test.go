@@ -0,0 +1,225 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type testSensitive struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password" infra:"sensitive"`
+	Nested   struct {
+		Token string `yaml:"token"`
+		Name  string `yaml:"name"`
+	} `yaml:"nested"`
+}
+
+func (s *testSensitive) Config() interface{} { return s }
+
+func (*testSensitive) Sensitive() []string { return []string{"nested.token"} }
+
+func init() {
+	infra.Register("testsensitive", new(testSensitive))
+}
+
+func TestMarshalRedacted(t *testing.T) {
+	schema := infra.Schema{
+		"secret":    new(testSecret),
+		"sensitive": new(testSensitive),
+	}
+	config, err := schema.Unmarshal([]byte(secretConfig + `sensitive: testsensitive
+testsensitive:
+  user: someone
+  password: hunter3
+  nested:
+    token: xyz
+    name: abc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), `instances:
+  testsecret: <redacted>
+secret: testsecret
+sensitive: testsensitive
+testsecret:
+  password: <redacted>
+  plain: notsecret
+  token: <redacted>
+testsensitive:
+  nested:
+    name: abc
+    token: <redacted>
+  password: <redacted>
+  user: someone
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Make sure the config itself was not modified.
+	var sensitive *testSensitive
+	config.Must(&sensitive)
+	if got, want := sensitive.Password, "hunter3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type testRedactOutputs struct {
+	URL   string       `yaml:"url"`
+	Token infra.Secret `yaml:"token"`
+}
+
+type testRedactInit struct {
+	instance infra.Secret
+	outputs  testRedactOutputs
+}
+
+func (r *testRedactInit) Init() error {
+	r.instance = "initsecret"
+	return nil
+}
+
+func (r *testRedactInit) InstanceConfig() interface{} { return &r.instance }
+
+func (r *testRedactInit) Outputs() interface{} { return &r.outputs }
+
+func init() {
+	infra.Register("testredactinit", new(testRedactInit))
+}
+
+func TestMarshalRedactedInitialized(t *testing.T) {
+	schema := infra.Schema{"redact": new(testRedactInit)}
+	config, err := schema.Unmarshal([]byte(`redact: testredactinit
+instances:
+  testredactinit: restored
+outputs:
+  testredactinit:
+    url: http://example.com
+    token: outputsecret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), `outputs:
+  testredactinit:
+    token: <redacted>
+    url: http://example.com
+redact: testredactinit
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var r *testRedactInit
+	config.Must(&r)
+	p, err = config.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), `instances:
+  testredactinit: <redacted>
+outputs:
+  testredactinit:
+    token: <redacted>
+    url: http://example.com
+redact: testredactinit
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMarshalRedactedInterpolated(t *testing.T) {
+	os.Setenv("INFRA_TEST_SECRET", "envsecret")
+	defer os.Unsetenv("INFRA_TEST_SECRET")
+	schema := infra.Schema{"sensitive": new(testSensitive)}
+	config, err := schema.Unmarshal([]byte(`sensitive: testsensitive
+testsensitive:
+  user: ${env:INFRA_TEST_SECRET}
+  password: ${env:INFRA_TEST_SECRET}
+  nested:
+    token: abc
+    name: user-${env:INFRA_TEST_SECRET}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sensitive *testSensitive
+	config.Must(&sensitive)
+	if got, want := sensitive.User, "envsecret"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "envsecret") {
+		t.Errorf("redacted config %s contains an interpolated secret", p)
+	}
+	if got, want := string(p), `sensitive: testsensitive
+testsensitive:
+  nested:
+    name: user-${env:INFRA_TEST_SECRET}
+    token: <redacted>
+  password: <redacted>
+  user: ${env:INFRA_TEST_SECRET}
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type testSensitiveOutputs struct {
+	outputs struct {
+		Host string `yaml:"host"`
+		Key  string `yaml:"key"`
+	}
+}
+
+func (s *testSensitiveOutputs) Outputs() interface{} { return &s.outputs }
+
+func (*testSensitiveOutputs) Sensitive() []string { return []string{"key"} }
+
+func init() {
+	infra.Register("testsensitiveoutputs", new(testSensitiveOutputs))
+}
+
+func TestMarshalRedactedSensitiveOutputs(t *testing.T) {
+	schema := infra.Schema{"endpoint": new(testSensitiveOutputs)}
+	config, err := schema.Unmarshal([]byte(`endpoint: testsensitiveoutputs
+outputs:
+  testsensitiveoutputs:
+    host: example.com
+    key: outputkey
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), `endpoint: testsensitiveoutputs
+outputs:
+  testsensitiveoutputs:
+    host: example.com
+    key: <redacted>
+versions: {}
+`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
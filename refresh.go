@@ -0,0 +1,86 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import "fmt"
+
+// Drift describes an instance whose infrastructure has drifted from
+// the state recorded in its configuration.
+type Drift struct {
+	// Key is the schema key of the drifted instance.
+	Key string
+	// Provider is the name of the instance's provider.
+	Provider string
+	// Details is the provider's description of the drift.
+	Details string
+}
+
+// Refresh performs drift detection: it compares the state recorded
+// by each configured instance whose provider implements Refresh
+// against the live infrastructure managed by it, and returns the
+// instances that have drifted. Instances are refreshed in dependency
+// order. If setup is true, then Setup is re-run for each drifted
+// instance, regardless of its version; the caller should then
+// (re-)marshal the configuration, as with Setup.
+func (c Config) Refresh(setup bool) ([]Drift, error) {
+	var drifts []Drift
+	for _, inst := range c.order {
+		if !inst.HasRefresh() {
+			continue
+		}
+		if err := inst.prepare((*instance).RequiresRefresh); err != nil {
+			return drifts, fmt.Errorf("refresh %s: %v", inst.Impl(), err)
+		}
+		drifted, details, err := c.refreshInstance(inst)
+		if err != nil {
+			return drifts, fmt.Errorf("refresh %s: %v", inst.Impl(), err)
+		}
+		if !drifted {
+			continue
+		}
+		drifts = append(drifts, Drift{c.key(inst), inst.Impl(), details})
+		if !setup {
+			continue
+		}
+		if err := inst.prepare((*instance).RequiresSetup); err != nil {
+			return drifts, fmt.Errorf("setup %s: %v", inst.Impl(), err)
+		}
+		if err := c.resetupInstance(inst); err != nil {
+			return drifts, err
+		}
+	}
+	return drifts, nil
+}
+
+// refreshInstance refreshes the instance while holding the config's
+// lock.
+func (c Config) refreshInstance(inst *instance) (drifted bool, details string, err error) {
+	defer c.lock()()
+	return inst.Refresh()
+}
+
+// resetupInstance sets up the drifted instance, regardless of its
+// version, while holding the config's lock.
+func (c Config) resetupInstance(inst *instance) error {
+	defer c.lock()()
+	if err := c.setupInstance(inst); err != nil {
+		return fmt.Errorf("setup %s: %v", inst.Impl(), err)
+	}
+	c.setVersion(inst)
+	return nil
+}
+
+// key returns the schema key bound to the provided instance, or to
+// the instance of which it is a part.
+func (c Config) key(inst *instance) string {
+	for typ, other := range c.instances {
+		for _, part := range other.parts() {
+			if part == inst {
+				return c.types[typ]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+// testBucket simulates a provider of a cloud resource whose live
+// state is stored in testBuckets.
+type testBucket struct {
+	Name   string `yaml:"name"`
+	Region string `yaml:"region"`
+
+	setups int
+}
+
+var testBuckets = map[string]string{}
+
+func (b *testBucket) Config() interface{} { return b }
+
+func (b *testBucket) Setup(creds *testCreds) error {
+	b.setups++
+	testBuckets[b.Name] = b.Region
+	return nil
+}
+
+func (b *testBucket) Refresh(creds *testCreds) (bool, string, error) {
+	region, ok := testBuckets[b.Name]
+	switch {
+	case !ok:
+		return true, "bucket " + b.Name + " does not exist", nil
+	case region != b.Region:
+		return true, "bucket " + b.Name + " is in region " + region, nil
+	}
+	return false, "", nil
+}
+
+func init() {
+	infra.Register("testbucket", new(testBucket))
+}
+
+func TestRefresh(t *testing.T) {
+	schema := infra.Schema{
+		"creds":  new(testCreds),
+		"bucket": new(testBucket),
+	}
+	config, err := schema.Unmarshal([]byte(`creds: testcreds
+bucket: testbucket
+testbucket:
+  name: refresh
+  region: us-west-2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err := config.Refresh(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("unexpected drift: %v", drifts)
+	}
+
+	testBuckets["refresh"] = "us-east-1"
+	drifts, err = config.Refresh(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []infra.Drift{{"bucket", "testbucket", "bucket refresh is in region us-east-1"}}
+	if got := drifts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	drifts, err = config.Refresh(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drifts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var bucket *testBucket
+	config.Must(&bucket)
+	if got, want := bucket.setups, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := testBuckets["refresh"], "us-west-2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	drifts, err = config.Refresh(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("unexpected drift: %v", drifts)
+	}
+}
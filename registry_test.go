@@ -0,0 +1,82 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+type testOtherCreds string
+
+func (c *testOtherCreds) User() string { return "other:" + string(*c) }
+
+func TestRegistry(t *testing.T) {
+	reg := infra.NewRegistry()
+	// The name testcreds is also registered in the default
+	// registry, with a different type.
+	reg.Register("testcreds", new(testOtherCreds))
+	typ, ok := reg.Lookup("testcreds")
+	if !ok {
+		t.Fatal("testcreds not registered")
+	}
+	if got, want := typ, reflect.TypeOf(new(testOtherCreds)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := reg.Lookup("testcluster"); ok {
+		t.Error("registry is not isolated from the default registry")
+	}
+	typ, ok = infra.DefaultRegistry.Lookup("testcreds")
+	if !ok {
+		t.Fatal("testcreds not registered")
+	}
+	if got, want := typ, reflect.TypeOf(new(testCreds)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	schema := infra.Schema{"creds": new(testOtherCreds)}
+	config, err := schema.MakeWithRegistry(reg, infra.Keys{"creds": "testcreds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var creds *testOtherCreds
+	config.Must(&creds)
+	if _, err := schema.Make(infra.Keys{"creds": "testcreds"}); err == nil {
+		t.Error("expected error")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic")
+			}
+		}()
+		reg.Register("testcreds", new(testOtherCreds))
+	}()
+}
+
+func TestRegisterBuiltins(t *testing.T) {
+	reg := infra.NewRegistry()
+	for _, name := range []string{"keyfile", "keyenv", "keynone"} {
+		if _, ok := reg.Lookup(name); ok {
+			t.Errorf("%s registered in a new registry", name)
+		}
+	}
+	infra.RegisterBuiltins(reg)
+	for _, name := range []string{"keyfile", "keyenv", "keynone"} {
+		if _, ok := reg.Lookup(name); !ok {
+			t.Errorf("%s not registered", name)
+		}
+	}
+	schema := infra.Schema{"secrets": new(infra.KeySource)}
+	config, err := schema.MakeWithRegistry(reg, infra.Keys{"secrets": "keynone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys infra.KeySource
+	config.Must(&keys)
+}
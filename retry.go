@@ -0,0 +1,96 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/retry"
+)
+
+// A RetryPolicy determines how failed calls to provider Init and
+// Setup methods are retried. The zero RetryPolicy performs no
+// retries.
+type RetryPolicy struct {
+	// Policy determines the number of attempts and the backoff
+	// between them (see package github.com/grailbio/base/retry).
+	// If nil, failed calls are not retried.
+	Policy retry.Policy
+	// Retryable returns whether the provided error is retryable.
+	// If nil, all errors from Init are retryable, and errors from
+	// Setup are not, since Setup methods need not be idempotent.
+	Retryable func(error) bool
+}
+
+// SetRetryPolicy sets the policy by which failed calls to the Init
+// and Setup methods of the configuration's providers are retried.
+// A failed call is retried only if its error is retryable according
+// to the policy; failures to initialize a provider's requirements
+// are not retried. Errors are returned only after the policy gives
+// up, and only the last error is returned.
+//
+// Initialization errors are memoized even when retries are
+// exhausted; see Reset. Eager instances are initialized by Make,
+// before a retry policy can be set; they may be retried with Reset
+// and InitAll.
+func (c Config) SetRetryPolicy(policy RetryPolicy) {
+	defer c.lock()()
+	c.retryPolicy.Store(policy)
+}
+
+// Reset resets the failed initialization of the instance bound to
+// the provided key, as well as those of the instances that failed
+// because they (transitively) require it. Instances decorated by
+// the reset instances and candidates of reset firstof instances are
+// also reset. The instances are initialized again when they are
+// next requested. Reset is a no-op for instances whose
+// initialization has not failed. Reset returns an error if no
+// instance is bound to the key.
+func (c Config) Reset(key string) error {
+	defer c.lock()()
+	inst := c.instanceFor(key)
+	if inst == nil {
+		return fmt.Errorf("no instance for key %s", key)
+	}
+	reset := map[*instance]bool{inst: true}
+	// Instances are ordered after their requirements.
+	for _, other := range c.order {
+		if other.Failed() && c.dependsOn(other, reset) {
+			reset[other] = true
+		}
+	}
+	for inst := range reset {
+		for _, part := range inst.parts() {
+			part.Reset()
+		}
+	}
+	return nil
+}
+
+// retry calls fn, which calls the instance's provider method
+// method, according to the instance's retry policy. Retries stop
+// when the provided context is done.
+func (inst *instance) retry(ctx context.Context, method string, fn func() error) error {
+	var policy RetryPolicy
+	if inst.config.retryPolicy != nil {
+		policy, _ = inst.config.retryPolicy.Load().(RetryPolicy)
+	}
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || policy.Policy == nil {
+			return err
+		}
+		if policy.Retryable == nil && method != "Init" {
+			return err
+		}
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return err
+		}
+		if retry.Wait(ctx, policy.Policy, retries) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/infra"
+)
+
+var (
+	errTransient = errors.New("transient error")
+	errPermanent = errors.New("permanent error")
+
+	// flakyFailures is the number of times testFlaky's Init and
+	// Setup methods fail before succeeding.
+	flakyFailures int
+)
+
+type testFlaky struct{}
+
+func (*testFlaky) Init() error {
+	if flakyFailures > 0 {
+		flakyFailures--
+		return errTransient
+	}
+	return nil
+}
+
+func (f *testFlaky) Setup() error { return f.Init() }
+
+type testFlakyUser struct{}
+
+func (*testFlakyUser) Init(flaky *testFlaky) error { return nil }
+
+func init() {
+	infra.Register("testflaky", new(testFlaky))
+	infra.Register("testflakyuser", new(testFlakyUser))
+}
+
+var flakySchema = infra.Schema{
+	"flaky": new(testFlaky),
+	"user":  new(testFlakyUser),
+}
+
+func makeFlaky(t *testing.T) infra.Config {
+	t.Helper()
+	config, err := flakySchema.Make(infra.Keys{
+		"flaky": "testflaky",
+		"user":  "testflakyuser",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestReset(t *testing.T) {
+	config := makeFlaky(t)
+	flakyFailures = 1
+	var user *testFlakyUser
+	if got, want := config.Instance(&user), errTransient; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// The error is memoized.
+	if got, want := config.Instance(&user), errTransient; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Resetting flaky also resets its dependent.
+	if err := config.Reset("flaky"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Instance(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reset("bogus"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestResetCandidate(t *testing.T) {
+	config, err := flakySchema.Make(infra.Keys{
+		"flaky": "firstof(testflaky)",
+		"user":  "testflakyuser",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flakyFailures = 1
+	var flaky *testFlaky
+	if err := config.Instance(&flaky); err == nil {
+		t.Fatal("expected error")
+	}
+	// Resetting the firstof instance also resets its failed candidate.
+	if err := config.Reset("flaky"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Instance(&flaky); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	config := makeFlaky(t)
+	config.SetRetryPolicy(infra.RetryPolicy{Policy: retry.MaxTries(nil, 3)})
+	flakyFailures = 2
+	var flaky *testFlaky
+	if err := config.Instance(&flaky); err != nil {
+		t.Fatal(err)
+	}
+	// Setup is not retried by default.
+	flakyFailures = 1
+	if err := config.Setup(); err == nil {
+		t.Fatal("expected error")
+	}
+	flakyFailures = 0
+
+	config = makeFlaky(t)
+	config.SetRetryPolicy(infra.RetryPolicy{
+		Policy:    retry.MaxTries(nil, 3),
+		Retryable: func(err error) bool { return err == errTransient },
+	})
+	flakyFailures = 2
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	config = makeFlaky(t)
+	config.SetRetryPolicy(infra.RetryPolicy{
+		Policy:    retry.MaxTries(nil, 3),
+		Retryable: func(err error) bool { return err == errPermanent },
+	})
+	flakyFailures = 1
+	if got, want := config.Instance(&flaky), errTransient; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	flakyFailures = 0
+}
+
+func TestRetryContext(t *testing.T) {
+	config := makeFlaky(t)
+	config.SetRetryPolicy(infra.RetryPolicy{Policy: retry.Backoff(time.Hour, time.Hour, 1)})
+	flakyFailures = 1
+	defer func() { flakyFailures = 0 }()
+	// Retries give up rather than wait past the context's deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := config.InitAll(ctx)
+	if err == nil || err.Error() != "init testflaky: transient error" {
+		t.Errorf("got %v, want transient error", err)
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/grailbio/base/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func init() {
+	RegisterBuiltins(DefaultRegistry)
+}
+
+// RegisterBuiltins registers the providers defined by package infra
+// ("keyfile", "keyenv", and "keynone") in the registry r. They are
+// registered in DefaultRegistry when the package is initialized;
+// RegisterBuiltins makes them available in other registries.
+func RegisterBuiltins(r *Registry) {
+	r.Register("keyfile", new(KeyFile))
+	r.Register("keyenv", new(KeyEnv))
+	r.Register("keynone", new(KeyNone))
+}
+
+// secretPrefix prefixes encrypted secrets in marshaled
+// configurations.
+const secretPrefix = "infrasecret:v1:"
+
+// errNoKeySource is returned when secrets are marshaled or
+// unmarshaled by a config without a key source.
+var errNoKeySource = errors.New("no key source is configured")
+
+var (
+	typeOfSecret    = reflect.TypeOf(Secret(""))
+	typeOfKeySource = reflect.TypeOf((*KeySource)(nil)).Elem()
+)
+
+// Secret is a string-valued secret. Values of type Secret in a
+// provider's configuration or instance configuration are encrypted
+// when the configuration is marshaled, and decrypted when it is
+// unmarshaled. Fields of any type may also be marked secret with
+// the struct tag `infra:"secret"`; their whole (YAML-marshaled)
+// value is then encrypted.
+//
+// Secrets are encrypted only if the config's schema binds a key to
+// the KeySource type, for example:
+//
+//	var schema = infra.Schema{
+//		"secrets": new(infra.KeySource),
+//		...
+//	}
+//
+// with a configuration such as "secrets: keyfile,file=/path/to/key".
+// Without a key source, secrets are marshaled in plaintext, and a
+// warning is logged; the "keynone" key source marshals secrets in
+// plaintext without a warning. Encrypted secrets are always
+// decrypted on unmarshal; it is an error to unmarshal an encrypted
+// secret without a key source that encrypts.
+type Secret string
+
+// A KeySource provides key material used to encrypt and decrypt
+// secrets. The key material is hashed with SHA-256 to derive an
+// AES-256 key. KeySources are provided by infrastructure providers;
+// package infra provides the "keyfile", "keyenv", and "keynone"
+// providers.
+// Providers of KeySources may not depend on other providers, and
+// their configurations may not themselves contain secrets.
+type KeySource interface {
+	// Key returns the key material used for encryption.
+	Key() ([]byte, error)
+}
+
+// KeyFile is a KeySource provider that reads its key material from
+// the file named by its flag "file".
+type KeyFile struct {
+	path string
+	key  []byte
+}
+
+// Help implements infra.Provider.
+func (KeyFile) Help() string {
+	return "encrypt secrets using key material stored in a file"
+}
+
+// Flags implements infra.Provider.
+func (f *KeyFile) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&f.path, "file", "", "path of the file containing the key material")
+}
+
+// Init implements infra.Provider.
+func (f *KeyFile) Init() error {
+	if f.path == "" {
+		return errors.New("infra.KeyFile: no key file specified")
+	}
+	var err error
+	f.key, err = ioutil.ReadFile(f.path)
+	if err == nil && len(f.key) == 0 {
+		err = fmt.Errorf("infra.KeyFile: key file %s is empty", f.path)
+	}
+	return err
+}
+
+// Key implements KeySource.
+func (f *KeyFile) Key() ([]byte, error) { return f.key, nil }
+
+// KeyEnv is a KeySource provider that reads its key material from
+// the environment variable named by its flag "var".
+type KeyEnv struct {
+	name string
+}
+
+// Help implements infra.Provider.
+func (KeyEnv) Help() string {
+	return "encrypt secrets using key material stored in an environment variable"
+}
+
+// Flags implements infra.Provider.
+func (e *KeyEnv) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&e.name, "var", "INFRA_SECRET_KEY", "name of the environment variable containing the key material")
+}
+
+// Key implements KeySource.
+func (e *KeyEnv) Key() ([]byte, error) {
+	key := os.Getenv(e.name)
+	if key == "" {
+		return nil, fmt.Errorf("infra.KeyEnv: environment variable %s is not set", e.name)
+	}
+	return []byte(key), nil
+}
+
+// KeyNone is a KeySource provider that does not encrypt secrets:
+// configurations that use it marshal their secrets in plaintext.
+// It is meant for tests and local development.
+type KeyNone struct{}
+
+// Help implements infra.Provider.
+func (KeyNone) Help() string {
+	return "store secrets unencrypted, in plaintext"
+}
+
+// Key implements KeySource. KeyNone provides no key material.
+func (*KeyNone) Key() ([]byte, error) { return nil, nil }
+
+// keySource returns the instance that provides the config's
+// KeySource, or nil if there is none.
+func (c Config) keySource() *instance {
+	typ, err := assignUnique(typeOfKeySource, c.typeset)
+	if err != nil {
+		return nil
+	}
+	return c.instances[typ]
+}
+
+// secretCipher returns the AEAD used to encrypt and decrypt secrets,
+// or nil if the config's key source is KeyNone. secretCipher returns
+// errNoKeySource if the config does not have a key source.
+func (c Config) secretCipher() (cipher.AEAD, error) {
+	inst := c.keySource()
+	if inst == nil {
+		return nil, errNoKeySource
+	}
+	if err := inst.Init(); err != nil {
+		return nil, err
+	}
+	ks := c.getValue(inst, typeOfKeySource).Interface().(KeySource)
+	if _, ok := ks.(*KeyNone); ok {
+		return nil, nil
+	}
+	material, err := ks.Key()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(material)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the secrets contained in the provider and instance
+// configurations in keys, replacing them with their YAML trees. Empty
+// secrets are left as is.
+func (c Config) seal(keys Keys) error {
+	var (
+		aead      cipher.AEAD
+		plaintext bool
+	)
+	seal := func(v interface{}) (interface{}, error) {
+		paths := secretPaths(reflect.TypeOf(v))
+		if len(paths) == 0 {
+			return v, nil
+		}
+		var tree interface{}
+		if err := remarshal(v, &tree); err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			var err error
+			tree, err = rewrite(tree, path, func(v interface{}) (interface{}, error) {
+				if v == "" || plaintext {
+					return v, nil
+				}
+				if aead == nil {
+					var err error
+					aead, err = c.secretCipher()
+					if err == errNoKeySource {
+						log.Printf("infra: no key source is configured; marshaling secrets in plaintext")
+						plaintext = true
+						return v, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					if aead == nil {
+						plaintext = true
+						return v, nil
+					}
+				}
+				return encrypt(aead, v)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return tree, nil
+	}
+	instanceConfigs, _ := keys["instances"].(Keys)
+	for _, inst := range c.allInstances() {
+		impl := inst.Impl()
+		if v, ok := keys[impl]; ok {
+			var err error
+			if keys[impl], err = seal(v); err != nil {
+				return fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+		if v, ok := instanceConfigs[impl]; ok {
+			var err error
+			if instanceConfigs[impl], err = seal(v); err != nil {
+				return fmt.Errorf("%s: %v", impl, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unseal decrypts the encrypted secrets in the YAML tree src, which
+// is to be unmarshaled into dst, and returns the decrypted tree.
+func (c Config) unseal(src, dst interface{}) (interface{}, error) {
+	var aead cipher.AEAD
+	for _, path := range secretPaths(reflect.TypeOf(dst)) {
+		var err error
+		src, err = rewrite(src, path, func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok || !strings.HasPrefix(s, secretPrefix) {
+				return v, nil
+			}
+			if aead == nil {
+				var err error
+				if aead, err = c.secretCipher(); err == errNoKeySource {
+					return nil, errors.New("encrypted secret found but no key source is configured")
+				} else if err != nil {
+					return nil, err
+				}
+				if aead == nil {
+					return nil, errors.New("encrypted secret found but the key source does not encrypt")
+				}
+			}
+			return decrypt(aead, s)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// secretPaths returns the YAML paths of the secrets in values of
+// type typ. An empty path denotes that the value itself is a
+// secret.
+func secretPaths(typ reflect.Type) [][]string {
+	return taggedPaths(typ, []string{"secret"}, nil)
+}
+
+// taggedPaths returns the YAML paths of the values of type Secret
+// and of the fields tagged with any of the provided "infra" struct
+// tag options in values of type typ.
+func taggedPaths(typ reflect.Type, options []string, visiting map[reflect.Type]bool) [][]string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == typeOfSecret {
+		return [][]string{nil}
+	}
+	if typ.Kind() != reflect.Struct || visiting[typ] {
+		return nil
+	}
+	if visiting == nil {
+		visiting = make(map[reflect.Type]bool)
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+	var paths [][]string
+fields:
+	for _, f := range configFields(typ) {
+		for _, opt := range options {
+			if hasTagOption(f.Tag.Get("infra"), opt) {
+				paths = append(paths, []string{f.Name})
+				continue fields
+			}
+		}
+		for _, path := range taggedPaths(f.Type, options, visiting) {
+			paths = append(paths, append([]string{f.Name}, path...))
+		}
+	}
+	return paths
+}
+
+// hasTagOption tells whether the comma-separated struct tag value
+// contains the given option.
+func hasTagOption(tag, option string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite replaces the value at the provided path in the YAML tree
+// with the result of fn. Trees with missing paths are left
+// unchanged.
+func rewrite(tree interface{}, path []string, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	if len(path) == 0 {
+		if tree == nil {
+			return nil, nil
+		}
+		return fn(tree)
+	}
+	switch m := tree.(type) {
+	case map[interface{}]interface{}:
+		v, ok := m[path[0]]
+		if !ok {
+			return tree, nil
+		}
+		v, err := rewrite(v, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		m[path[0]] = v
+	case map[string]interface{}:
+		v, ok := m[path[0]]
+		if !ok {
+			return tree, nil
+		}
+		v, err := rewrite(v, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		m[path[0]] = v
+	case Keys:
+		v, ok := m[path[0]]
+		if !ok {
+			return tree, nil
+		}
+		v, err := rewrite(v, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		m[path[0]] = v
+	}
+	return tree, nil
+}
+
+func encrypt(aead cipher.AEAD, v interface{}) (string, error) {
+	plaintext, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func decrypt(aead cipher.AEAD, s string) (interface{}, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, secretPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret: %v", err)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("malformed secret: too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secret: %v", err)
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(plaintext, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
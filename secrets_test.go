@@ -0,0 +1,157 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/testutil"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type testSecretToken struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+type testSecret struct {
+	Password infra.Secret    `yaml:"password"`
+	Token    testSecretToken `yaml:"token" infra:"secret"`
+	Plain    string          `yaml:"plain"`
+
+	instance string
+}
+
+func (s *testSecret) Config() interface{} { return s }
+
+func (s *testSecret) InstanceConfig() interface{} {
+	return (*infra.Secret)(&s.instance)
+}
+
+func init() {
+	infra.Register("testsecret", new(testSecret))
+}
+
+const secretConfig = `secret: testsecret
+testsecret:
+  password: hunter2
+  token:
+    id: tokenid
+    key: tokenkey
+  plain: notsecret
+instances:
+  testsecret: instancesecret
+`
+
+func TestSecrets(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte("secret key material"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	schema := infra.Schema{
+		"secret": new(testSecret),
+		"keys":   new(infra.KeySource),
+	}
+	config, err := schema.Unmarshal([]byte("keys: keyfile,file=" + path + "\n" + secretConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"hunter2", "tokenid", "tokenkey", "instancesecret"} {
+		if strings.Contains(string(p), plaintext) {
+			t.Errorf("marshaled config %s contains secret %s", p, plaintext)
+		}
+	}
+	if !strings.Contains(string(p), "plain: notsecret") {
+		t.Errorf("marshaled config %s is missing plain value", p)
+	}
+	config, err = schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret *testSecret
+	config.Must(&secret)
+	if got, want := *secret, (testSecret{"hunter2", testSecretToken{"tokenid", "tokenkey"}, "notsecret", "instancesecret"}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Secrets are also decrypted in configurations made from maps
+	// keyed by strings.
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(p, &tree); err != nil {
+		t.Fatal(err)
+	}
+	sealed := make(map[string]interface{})
+	for k, v := range tree["testsecret"].(map[interface{}]interface{}) {
+		sealed[k.(string)] = v
+	}
+	config, err = schema.Make(infra.Keys{
+		"keys":       "keyfile,file=" + path,
+		"secret":     "testsecret",
+		"testsecret": sealed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = nil
+	config.Must(&secret)
+	if got, want := secret.Token, (testSecretToken{"tokenid", "tokenkey"}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Secrets cannot be decrypted with a different key.
+	if err := ioutil.WriteFile(path, []byte("other key material"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.Unmarshal(p); err == nil || !strings.Contains(err.Error(), "decrypt secret") {
+		t.Errorf("expected decryption error, got %v", err)
+	}
+	// Nor without a key source.
+	schema = infra.Schema{"secret": new(testSecret)}
+	if _, err := schema.Unmarshal(p); err == nil || !strings.Contains(err.Error(), "no key source") {
+		t.Errorf("expected key source error, got %v", err)
+	}
+}
+
+func TestSecretsPlaintext(t *testing.T) {
+	// Secrets are marshaled in plaintext without a key source.
+	schema := infra.Schema{"secret": new(testSecret)}
+	config, err := schema.Unmarshal([]byte(secretConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := config.Marshal(true); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(p), "tokenkey") {
+		t.Errorf("marshaled config %s does not contain the plaintext secret", p)
+	}
+	// And with the keynone key source.
+	schema = infra.Schema{
+		"secret": new(testSecret),
+		"keys":   new(infra.KeySource),
+	}
+	config, err = schema.Unmarshal([]byte("keys: keynone\n" + secretConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := config.Marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"hunter2", "tokenid", "tokenkey", "instancesecret"} {
+		if !strings.Contains(string(p), plaintext) {
+			t.Errorf("marshaled config %s does not contain %s", p, plaintext)
+		}
+	}
+}
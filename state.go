@@ -0,0 +1,132 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import "errors"
+
+var (
+	// ErrRevisionMismatch is returned by StateStore.Save when the
+	// stored configuration's revision does not match the expected
+	// revision.
+	ErrRevisionMismatch = errors.New("infra: state revision mismatch")
+
+	// ErrLocked is returned by StateStore.Lock when the store is
+	// locked by another party.
+	ErrLocked = errors.New("infra: state is locked")
+)
+
+// A StateStore persists marshaled configurations. Each stored
+// configuration has a revision, an opaque string that changes each
+// time the configuration is saved; StateStores use revisions to
+// implement compare-and-swap semantics, so that concurrent updates
+// are not lost. StateStores also provide an advisory lock that is
+// used to serialize updates across processes.
+type StateStore interface {
+	// Load returns the stored configuration and its revision. If no
+	// configuration is stored, Load returns a nil configuration and
+	// an empty revision.
+	Load() (p []byte, rev string, err error)
+
+	// Save stores the configuration p, provided that the currently
+	// stored configuration's revision is rev (an empty revision
+	// denotes that no configuration is stored). Save returns the
+	// revision of the saved configuration, or ErrRevisionMismatch if
+	// the stored revision differs from rev.
+	Save(p []byte, rev string) (newrev string, err error)
+
+	// Lock acquires the store's lock. Lock returns ErrLocked if the
+	// lock is held by another party.
+	Lock() error
+
+	// Unlock releases the store's lock.
+	Unlock() error
+}
+
+// A Persister durably persists marshaled configurations.
+type Persister interface {
+	// Persist persists the marshaled configuration p.
+	Persist(p []byte) error
+}
+
+// PersisterFunc adapts a function to a Persister.
+type PersisterFunc func(p []byte) error
+
+// Persist implements Persister.
+func (f PersisterFunc) Persist(p []byte) error { return f(p) }
+
+// SetupPersist performs setup as in Setup, persisting the
+// configuration with the provided persister after every successful
+// setup step, so that completed steps are durable before setup
+// proceeds. If persistence fails, setup is aborted. The
+// configuration is marshaled with its instance configurations, as
+// by Marshal(true), except that instances are not initialized in
+// order to be marshaled: the instance configurations of instances
+// that have not been initialized are persisted as they were
+// restored.
+func (c Config) SetupPersist(persister Persister) error {
+	return c.setupPersist(persister)
+}
+
+func (c Config) setupPersist(persister Persister) error {
+	return c.setup(func(*instance) error {
+		p, err := c.marshal(true)
+		if err != nil {
+			return err
+		}
+		return persister.Persist(p)
+	})
+}
+
+// persist persists the configuration with the provided persister
+// while holding the config's lock.
+func (c Config) persist(persister Persister) error {
+	defer c.lock()()
+	p, err := c.marshal(true)
+	if err != nil {
+		return err
+	}
+	return persister.Persist(p)
+}
+
+// SetupAndSave performs setup as in Setup while holding the store's
+// lock, persisting the configuration to the store after every
+// successful setup step, so that completed steps are not lost if
+// setup fails or the process dies. The configuration is also
+// persisted before setup begins. The configuration is marshaled as
+// by SetupPersist, with its instance configurations.
+//
+// The revision rev is the revision of the stored configuration from
+// which c was unmarshaled, as returned by store.Load, or empty if the
+// store was empty. SetupAndSave fails with ErrRevisionMismatch,
+// without performing setup, if the store has since been modified,
+// so that the changes of other parties are not overwritten by a
+// stale configuration. Subsequent saves are conditioned on the
+// revisions of SetupAndSave's own saves.
+func (c Config) SetupAndSave(store StateStore, rev string) (err error) {
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := store.Unlock(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	_, current, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if current != rev {
+		return ErrRevisionMismatch
+	}
+	persister := PersisterFunc(func(p []byte) error {
+		var err error
+		rev, err = store.Save(p, rev)
+		return err
+	})
+	if err := c.persist(persister); err != nil {
+		return err
+	}
+	return c.setupPersist(persister)
+}
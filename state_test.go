@@ -0,0 +1,224 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/testutil"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "config.yaml")
+	store1, store2 := infra.NewFileStore(path), infra.NewFileStore(path)
+	if err := store1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store2.Lock(), infra.ErrLocked; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	rev, err := store1.Save([]byte("one"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store1.Save([]byte("two"), ""); err != infra.ErrRevisionMismatch {
+		t.Errorf("got %v, want %v", err, infra.ErrRevisionMismatch)
+	}
+	if err := store1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	p, rev2, err := store2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), "one"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rev2, rev; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetupAndSave(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	store := infra.NewFileStore(filepath.Join(dir, "config.yaml"))
+
+	// Setup of the cluster fails, but setup of its
+	// dependencies should still be saved.
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetupAndSave(store, ""); err == nil {
+		t.Fatal("expected error")
+	}
+	p, rev, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "versions:\n  testcreds: 0\n") {
+		t.Errorf("saved config %s does not contain setup versions", p)
+	}
+
+	config, err = schema.Unmarshal([]byte(strings.Replace(string(p), `testcreds: ""`, "testcreds: xyz", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetupAndSave(store, rev); err != nil {
+		t.Fatal(err)
+	}
+	p, rev, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"  setup_user: xyz\n", "  testcluster: 1\n"} {
+		if !strings.Contains(string(p), want) {
+			t.Errorf("saved config %s does not contain %q", p, want)
+		}
+	}
+
+	// Instance configurations are persisted, including those of
+	// instances that were not initialized by setup.
+	config, err = schema.Unmarshal([]byte(`creds: testcreds,user=xyz
+cluster: testcluster
+instances:
+  testcluster:
+    instance_user: precious
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetupAndSave(store, rev); err != nil {
+		t.Fatal(err)
+	}
+	p, rev, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "instances:\n  testcluster:\n    instance_user: precious\n"; !strings.Contains(string(p), want) {
+		t.Errorf("saved config %s does not contain %q", p, want)
+	}
+
+	// The lock must be released.
+	if err := store.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetupAndSave(store, rev); err != infra.ErrLocked {
+		t.Errorf("got %v, want %v", err, infra.ErrLocked)
+	}
+	if err := store.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupAndSaveConflict(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	store := infra.NewFileStore(filepath.Join(dir, "config.yaml"))
+	rev, err := store.Save([]byte("creds: testcreds,user=xyz\ncluster: testcluster\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != rev {
+		t.Fatalf("got %v, want %v", loaded, rev)
+	}
+	config, err := schema.Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another writer saves a new configuration after the config was
+	// loaded.
+	const other = "creds: testcreds,user=other\ncluster: testcluster\n"
+	if _, err := store.Save([]byte(other), rev); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.SetupAndSave(store, loaded), infra.ErrRevisionMismatch; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, _, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), other; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetupPersist(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted []string
+	err = config.SetupPersist(infra.PersisterFunc(func(p []byte) error {
+		persisted = append(persisted, string(p))
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(persisted), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, want := range []string{"  setup_user: xyz\n", "  testsetup: 1\n", "instances:\n"} {
+		if !strings.Contains(persisted[2], want) {
+			t.Errorf("persisted config %s does not contain %q", persisted[2], want)
+		}
+	}
+	// Setup is not performed again for up-to-date providers.
+	persisted = nil
+	if err := config.SetupPersist(infra.PersisterFunc(func(p []byte) error {
+		persisted = append(persisted, string(p))
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(persisted), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetupPersistError(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=xyz",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errPersist := errors.New("persist failed")
+	err = config.SetupPersist(infra.PersisterFunc(func(p []byte) error {
+		return errPersist
+	}))
+	if got, want := err, errPersist; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Setup was aborted after the first step.
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "testcluster: 1") {
+		t.Errorf("setup was not aborted: %s", p)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import "fmt"
+
+// Teardown removes the infrastructure set up by the configuration:
+// it calls Teardown on each instance that has been set up and whose
+// provider implements Teardown, in reverse dependency order, so
+// that instances are torn down before the instances they require.
+// The versions of torn down instances are removed from the
+// configuration, so that a subsequent Setup sets them up anew. As
+// with Setup, the caller should (re-)marshal the configuration after
+// teardown completes.
+func (c Config) Teardown() error {
+	for i := len(c.order) - 1; i >= 0; i-- {
+		inst := c.order[i]
+		impl := inst.Impl()
+		if !c.isSetup(inst) {
+			continue
+		}
+		target := inst
+		if inst.candidates != nil {
+			// The candidate that was set up is the recorded choice.
+			if err := inst.Init(); err != nil {
+				return fmt.Errorf("teardown %s: %v", impl, err)
+			}
+			target = inst.selected()
+		}
+		if !target.HasTeardown() {
+			continue
+		}
+		if err := target.prepare((*instance).RequiresTeardown); err != nil {
+			return fmt.Errorf("teardown %s: %v", impl, err)
+		}
+		if err := c.teardownInstance(inst, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSetup returns whether the instance has been set up.
+func (c Config) isSetup(inst *instance) bool {
+	defer c.rlock()()
+	_, ok := c.versions[inst.Impl()]
+	return ok
+}
+
+// teardownInstance tears down the target (the instance, or its
+// chosen candidate) while holding the config's lock.
+func (c Config) teardownInstance(inst, target *instance) error {
+	defer c.lock()()
+	impl := inst.Impl()
+	if _, ok := c.versions[impl]; !ok {
+		return nil
+	}
+	if err := target.Teardown(); err != nil {
+		return fmt.Errorf("teardown %s: %v", impl, err)
+	}
+	c.clearVersion(inst)
+	return nil
+}
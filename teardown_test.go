@@ -0,0 +1,98 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+// teardowns records the order in which test providers are torn down.
+var teardowns []string
+
+type testTeardownBucket struct {
+	Owner string `yaml:"owner"`
+}
+
+func (b *testTeardownBucket) Setup(creds *testCreds) error {
+	b.Owner = string(*creds)
+	return nil
+}
+
+func (b *testTeardownBucket) Teardown(creds *testCreds) error {
+	teardowns = append(teardowns, "testteardownbucket:"+string(*creds))
+	b.Owner = ""
+	return nil
+}
+
+func (b *testTeardownBucket) Config() interface{} { return b }
+
+type testTeardownObject struct {
+	Bucket string `yaml:"bucket"`
+}
+
+func (o *testTeardownObject) Setup(bucket *testTeardownBucket) error {
+	o.Bucket = bucket.Owner
+	return nil
+}
+
+func (o *testTeardownObject) Teardown(bucket *testTeardownBucket) error {
+	teardowns = append(teardowns, "testteardownobject")
+	o.Bucket = ""
+	return nil
+}
+
+func (o *testTeardownObject) Config() interface{} { return o }
+
+func init() {
+	infra.Register("testteardownbucket", new(testTeardownBucket))
+	infra.Register("testteardownobject", new(testTeardownObject))
+}
+
+func TestTeardown(t *testing.T) {
+	schema := infra.Schema{
+		"creds":  new(testCreds),
+		"bucket": new(testTeardownBucket),
+		"object": new(testTeardownObject),
+	}
+	config, err := schema.Make(infra.Keys{
+		"creds":  "testcreds,user=xyz",
+		"bucket": "testteardownbucket",
+		"object": "testteardownobject",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	teardowns = nil
+	// Nothing has been set up yet.
+	if err := config.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	if len(teardowns) != 0 {
+		t.Errorf("got %v, want no teardowns", teardowns)
+	}
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := teardowns, []string{"testteardownobject", "testteardownbucket:xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "testteardownbucket: 0") || strings.Contains(string(p), "testteardownobject: 0") {
+		t.Errorf("marshaled config %s contains versions of torn down instances", p)
+	}
+	if steps := config.Plan(); len(steps) != 2 {
+		t.Errorf("got %v, want 2 steps", steps)
+	}
+}
@@ -24,7 +24,14 @@ import (
 	"github.com/grailbio/infra"
 )
 
-func init() { infra.Register("tls", new(Authority)) }
+func init() { RegisterProviders(infra.DefaultRegistry) }
+
+// RegisterProviders registers the providers defined by this package
+// in the registry reg. They are registered in infra.DefaultRegistry
+// when the package is initialized.
+func RegisterProviders(reg *infra.Registry) {
+	reg.Register("tls", new(Authority))
+}
 
 var (
 	certDuration = 27 * 7 * 24 * time.Hour
@@ -179,12 +186,14 @@ func (ca *Authority) Init() error {
 func (ca *Authority) Certificate() *x509.Certificate { return ca.cert }
 
 // InstanceConfig implements infra.Provider, allowing for the authority's
-// certificate material to be marshaled inline.
+// certificate material to be marshaled inline. The certificate material
+// includes the authority's private key, and is thus marshaled as an
+// infra.Secret.
 func (ca *Authority) InstanceConfig() interface{} {
 	if ca.pemBlock == nil {
 		ca.pemBlock = new(string)
 	}
-	return ca.pemBlock
+	return (*infra.Secret)(ca.pemBlock)
 }
 
 // Issue issues a new certificate out of this CA with the provided
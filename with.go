@@ -0,0 +1,211 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"reflect"
+)
+
+// With returns a child configuration of c, in which the provided
+// keys override those of c. Overrides replace whole top-level keys:
+// they may rebind schema keys to different providers (or provider
+// flags), or replace provider configurations.
+//
+// The child shares with its parent every instance that is not
+// affected by the overrides, including their initialization state:
+// instances that are already initialized in the parent are not
+// initialized again by the child. Instances whose schema keys or
+// provider configurations are overridden are re-instantiated, as
+// are all instances that (transitively) depend on them. The
+// instance configurations of re-instantiated instances are not
+// inherited from the parent, nor are the provider configurations of
+// providers bound by the overrides.
+//
+// The child shares its parent's lock, so that setup of the shared
+// instances is serialized between the two configs. The child keeps
+// its own copy of the parent's provider versions, without those of
+// re-instantiated instances: setup of a shared instance is recorded
+// in both configs, while setup of a re-instantiated instance is
+// recorded only in the child. The child starts with a copy of the
+// parent's retry policy, observer, and audit options. Eager
+// instances of the child are initialized once the child is built.
+//
+// With is useful to specialize a configuration, for example per
+// tenant or per request, without rebuilding its entire provider
+// graph.
+func (c Config) With(overrides Keys) (Config, error) {
+	child, err := c.with(overrides)
+	if err != nil {
+		return Config{}, err
+	}
+	// Eager instances are initialized without holding the lock, so
+	// that they may use the config.
+	if err := child.initAll(context.Background(), (*instance).Eager); err != nil {
+		return Config{}, err
+	}
+	return child, nil
+}
+
+// with builds the child configuration of c as in With, without
+// initializing eager instances.
+func (c Config) with(overrides Keys) (Config, error) {
+	defer c.rlock()()
+	keys := c.Keys.Clone()
+	versions := make(map[string]int, len(c.versions))
+	for impl, version := range c.versions {
+		versions[impl] = version
+	}
+	keys["versions"] = versions
+
+	changed := make(map[string]bool)
+	for k, v := range overrides {
+		if reflect.DeepEqual(keys[k], v) {
+			continue
+		}
+		changed[k] = true
+		// If k is a schema key, its provider changes.
+		for _, w := range []interface{}{keys[k], v} {
+			if s, ok := w.(string); ok {
+				changed[providerName(s)] = true
+			}
+		}
+		keys[k] = deepcopy(v)
+	}
+	// Rebound providers are configured by their (new) flags, not by
+	// the parent's provider configurations.
+	for k, v := range overrides {
+		s, ok := v.(string)
+		if !ok || !changed[k] {
+			continue
+		}
+		if impl := providerName(s); overrides[impl] == nil {
+			delete(keys, impl)
+		}
+	}
+	child, err := c.schema.make(c.registry, keys)
+	if err != nil {
+		return Config{}, err
+	}
+	fresh, err := child.affected(changed)
+	if err != nil {
+		return Config{}, err
+	}
+	// Rebuild the child without the instance configurations and
+	// versions of re-instantiated instances. The discarded child's
+	// instances were never initialized, since make does not
+	// initialize eager instances.
+	if len(fresh) > 0 {
+		instanceConfigs, _ := keys["instances"].(Keys)
+		for inst := range fresh {
+			delete(instanceConfigs, inst.Impl())
+			delete(versions, inst.Impl())
+		}
+		if child, err = c.schema.make(c.registry, keys); err != nil {
+			return Config{}, err
+		}
+		if fresh, err = child.affected(changed); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Replace the remaining instances with the parent's.
+	shared := make(map[*instance]*instance)
+	for typ, inst := range child.instances {
+		if fresh[inst] {
+			continue
+		}
+		parent := c.instances[typ]
+		if parent == nil || parent.Impl() != inst.Impl() {
+			continue
+		}
+		child.instances[typ] = parent
+		// Decorated instances and candidates are shared along
+		// with the instances of which they are parts.
+		parts, parentParts := inst.parts(), parent.parts()
+		for i := range parts {
+			if i < len(parentParts) {
+				shared[parts[i]] = parentParts[i]
+			}
+		}
+	}
+	instanceConfigs, _ := child.Keys["instances"].(Keys)
+	outputs, _ := child.Keys["outputs"].(Keys)
+	for _, parent := range shared {
+		impl := parent.Impl()
+		if config := parent.Config(); config != nil {
+			child.Keys[impl] = config
+		}
+		if config := parent.InstanceConfig(); config != nil && instanceConfigs != nil {
+			instanceConfigs[impl] = config
+		}
+		if output := parent.Outputs(); output != nil {
+			child.outputs[reflect.TypeOf(output)] = parent
+			if outputs != nil {
+				outputs[impl] = output
+			}
+		}
+	}
+	for i, inst := range child.order {
+		if parent := shared[inst]; parent != nil {
+			child.order[i] = parent
+		}
+	}
+	child.mu = c.mu
+	child.refs = c.refs
+	if policy := c.retryPolicy.Load(); policy != nil {
+		child.retryPolicy.Store(policy)
+	}
+	if obs := c.observer.Load(); obs != nil {
+		child.observer.Store(obs)
+	}
+	c.audit.mu.Lock()
+	child.audit.opts = c.audit.opts
+	c.audit.mu.Unlock()
+	// Re-instantiated instances belong to the child: they use its
+	// lock, versions, and references.
+	for inst := range fresh {
+		inst.config = child
+	}
+	return child, nil
+}
+
+// affected returns the instances that are affected by changes to the
+// provided keys: those bound to the keys, those whose providers are
+// named by the keys, and those that (transitively) depend on them.
+func (c Config) affected(changed map[string]bool) (map[*instance]bool, error) {
+	affected := make(map[*instance]bool)
+	for typ, inst := range c.instances {
+		// All parts of an instance are affected by changes to its
+		// key.
+		key := changed[c.types[typ]]
+		for _, part := range inst.parts() {
+			if key || changed[part.Impl()] {
+				affected[part] = true
+			}
+		}
+	}
+	for {
+		n := len(affected)
+		for _, inst := range c.allInstances() {
+			if affected[inst] {
+				continue
+			}
+			dsts, err := c.requirements(inst)
+			if err != nil {
+				return nil, err
+			}
+			for _, dst := range dsts {
+				if affected[dst] {
+					affected[inst] = true
+					break
+				}
+			}
+		}
+		if len(affected) == n {
+			return affected, nil
+		}
+	}
+}
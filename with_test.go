@@ -0,0 +1,192 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package infra_test
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/infra"
+)
+
+func TestWith(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=parent",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		cluster *testCluster
+		setup   *testSetup
+	)
+	config.Must(&cluster)
+	config.Must(&setup)
+	if got, want := cluster.User, "parent"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	child, err := config.With(infra.Keys{"creds": "testcreds,user=tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		childCluster *testCluster
+		childSetup   *testSetup
+	)
+	child.Must(&childCluster)
+	child.Must(&childSetup)
+	if got, want := childCluster.User, "tenant"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if childCluster.FromInstance {
+		t.Error("child cluster inherited the parent's instance config")
+	}
+	if got, want := cluster.User, "parent"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if childSetup != setup {
+		t.Error("unaffected instance was not shared with the parent")
+	}
+
+	// An override that does not change anything shares every instance.
+	same, err := config.With(infra.Keys{"creds": "testcreds,user=parent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sameCluster *testCluster
+	same.Must(&sameCluster)
+	if sameCluster != cluster {
+		t.Error("unchanged instance was not shared with the parent")
+	}
+}
+
+func TestWithSetup(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=parent",
+		"cluster": "testcluster",
+		"setup":   "testsetup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := config.With(infra.Keys{"creds": "testcreds,user=tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	// Setup of the shared instance is recorded in the parent.
+	p, err := config.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "  testsetup: 1\n") {
+		t.Errorf("parent config %s does not record the child's setup", p)
+	}
+}
+
+func TestWithVersions(t *testing.T) {
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=parent",
+		"cluster": "testcluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := config.With(infra.Keys{"creds": "testcreds,user=tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Setup of the parent's cluster is not recorded in the child.
+	if err := config.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	var cluster *testCluster
+	child.Must(&cluster)
+	if got, want := cluster.SetupUser, "tenant"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Nor is the parent's setup inherited by later children.
+	config.Must(&cluster)
+	cluster.SetupUser = ""
+	child, err = config.With(infra.Keys{"creds": "testcreds,user=other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := new(recordingObserver)
+	child.SetObserver(obs)
+	if err := child.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	child.Must(&cluster)
+	if got, want := cluster.SetupUser, "other"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var setups []string
+	for _, ev := range obs.events {
+		if strings.HasPrefix(ev, "setup-") {
+			setups = append(setups, ev)
+		}
+	}
+	if got, want := setups, []string{
+		"setup-start cluster testcluster -1->1",
+		"setup-end cluster testcluster -1->1",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	config.Must(&cluster)
+	if cluster.SetupUser != "" {
+		t.Error("child setup set up the parent's cluster")
+	}
+}
+
+// eagerInits counts the initializations of testEagerCreds.
+var eagerInits int32
+
+type testEagerCreds struct{}
+
+func (*testEagerCreds) Init(creds *testCreds) error {
+	atomic.AddInt32(&eagerInits, 1)
+	return nil
+}
+
+func (*testEagerCreds) Eager() bool { return true }
+
+func init() {
+	infra.Register("testeagercreds", new(testEagerCreds))
+}
+
+func TestWithEager(t *testing.T) {
+	schema := infra.Schema{
+		"creds":   new(testCreds),
+		"cluster": new(testCluster),
+		"eager":   new(testEagerCreds),
+	}
+	config, err := schema.Make(infra.Keys{
+		"creds":   "testcreds,user=parent",
+		"cluster": "testcluster",
+		"eager":   "testeagercreds",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&eagerInits, 0)
+	if _, err := config.With(infra.Keys{"creds": "testcreds,user=tenant"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&eagerInits), int32(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}